@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kebe7jun/ropee/storage"
+	"gopkg.in/yaml.v2"
+)
+
+// loadConfig returns base overridden by the options set in file and validates it,
+// options missing in file keep the values of base (the flags).
+func loadConfig(base Config, file string) (Config, error) {
+	c := base
+	if file == "" {
+		return c, c.validate()
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return c, fmt.Errorf("parse %s: %s", file, err)
+	}
+	return c, c.validate()
+}
+
+func (c Config) validate() error {
+	if _, err := c.retryPolicy(); err != nil {
+		return err
+	}
+	if !storage.ValidAggregation(c.ReadAggregation) {
+		return fmt.Errorf("invalid read-aggregation %s", c.ReadAggregation)
+	}
+	if _, err := storage.ParseMetricAggregations(c.ReadMetricAggregations); err != nil {
+		return err
+	}
+	switch c.ReadSearchMode {
+	case storage.SearchModeJob, storage.SearchModeOneshot, storage.SearchModeExport:
+	default:
+		return fmt.Errorf("invalid read-search-mode %s", c.ReadSearchMode)
+	}
+	switch c.HECFormat {
+	case storage.HECFormatEvent, storage.HECFormatMetric, storage.HECFormatMultiMetric:
+	default:
+		return fmt.Errorf("invalid splunk-hec-format %s", c.HECFormat)
+	}
+	if c.WriteAuth.Password != "" && c.WriteAuth.Username == "" {
+		return fmt.Errorf("write-basic-auth-password needs write-basic-auth-username")
+	}
+	return nil
+}
+
+func (c Config) retryPolicy() (storage.RetryPolicy, error) {
+	p := storage.RetryPolicy{
+		MaxAttempts:     c.RetryMaxAttempts,
+		BaseBackoff:     c.RetryBaseBackoff,
+		MaxBackoff:      c.RetryMaxBackoff,
+		Jitter:          c.RetryJitter,
+		RetryableStatus: map[int]bool{},
+	}
+	for _, code := range strings.Split(c.RetryStatusCodes, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			return p, fmt.Errorf("invalid retry status code %q", code)
+		}
+		p.RetryableStatus[status] = true
+	}
+	return p, nil
+}
+
+func (c Config) readOptions() storage.ReadOptions {
+	metricAggregations, _ := storage.ParseMetricAggregations(c.ReadMetricAggregations)
+	return storage.ReadOptions{
+		DefaultAggregation: c.ReadAggregation,
+		MetricAggregations: metricAggregations,
+		RawMaxRangeMs:      int64(c.ReadRawMaxRange / time.Millisecond),
+		PushdownGrouping:   c.ReadPushdownGrouping,
+	}
+}
+
+func (c Config) webTLSEnabled() bool {
+	return c.WebTLSCertFile != "" || c.WebTLSKeyFile != "" || c.WebTLSClientCAFile != ""
+}
+
+// keepStatic copies the options which only apply on start from prev to c,
+// it returns the names of the options whose change was ignored.
+func (c *Config) keepStatic(prev Config) []string {
+	ignored := make([]string, 0)
+	keep := func(name string, changed bool) {
+		if changed {
+			ignored = append(ignored, name)
+		}
+	}
+	keep("listen_addr", c.ListenAddr != prev.ListenAddr)
+	keep("log_file_path", c.LogFilePath != prev.LogFilePath)
+	keep("debug", c.Debug != prev.Debug)
+	keep("web_enable_admin_api", c.WebEnableAdminAPI != prev.WebEnableAdminAPI)
+	keep("wal_dir", c.WALDir != prev.WALDir)
+	keep("wal_segment_size", c.WALSegmentSize != prev.WALSegmentSize)
+	keep("wal_max_size", c.WALMaxSize != prev.WALMaxSize)
+	keep("wal_max_age", c.WALMaxAge != prev.WALMaxAge)
+	c.ListenAddr, c.LogFilePath, c.Debug = prev.ListenAddr, prev.LogFilePath, prev.Debug
+	c.WebEnableAdminAPI = prev.WebEnableAdminAPI
+	c.WALDir, c.WALSegmentSize, c.WALMaxSize, c.WALMaxAge = prev.WALDir, prev.WALSegmentSize, prev.WALMaxSize, prev.WALMaxAge
+	// certificates can be changed, but https can not be switched on or off.
+	if c.webTLSEnabled() != prev.webTLSEnabled() {
+		ignored = append(ignored, "web_tls_cert_file")
+		c.WebTLSCertFile, c.WebTLSKeyFile, c.WebTLSClientCAFile = prev.WebTLSCertFile, prev.WebTLSKeyFile, prev.WebTLSClientCAFile
+	}
+	return ignored
+}
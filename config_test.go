@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kebe7jun/ropee/storage"
+	"github.com/kebe7jun/ropee/test"
+)
+
+// testFlags returns a valid config as parsed from the command line.
+func testFlags(file string) Config {
+	return Config{
+		ConfigFile:         file,
+		SplunkUrl:          "https://127.0.0.1:8089",
+		SplunkMetricsIndex: "metrics",
+		SplunkHECURL:       "https://127.0.0.1:8088",
+		TimeoutSeconds:     60,
+		HECFormat:          storage.HECFormatEvent,
+		RetryMaxAttempts:   3,
+		RetryStatusCodes:   "429,503",
+		ReadAggregation:    storage.AggregationLatest,
+		ReadSearchMode:     storage.SearchModeJob,
+		ListenAddr:         "127.0.0.1:9970",
+	}
+}
+
+func writeConfigFile(t *testing.T, file, content string) {
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ropee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ropee.yml")
+	cases := []struct {
+		name      string
+		content   string
+		wannaErr  bool
+		wannaConf func(c *Config)
+	}{
+		{
+			"file overrides flags",
+			"splunk_metrics_index: other\nread_search_mode: oneshot\nwrite_auth:\n  bearer_token: secret\n",
+			false,
+			func(c *Config) {
+				c.SplunkMetricsIndex = "other"
+				c.ReadSearchMode = storage.SearchModeOneshot
+				c.WriteAuth.BearerToken = "secret"
+			},
+		},
+		{
+			"empty file keeps flags",
+			"",
+			false,
+			func(c *Config) {},
+		},
+		{
+			"unknown option",
+			"splunk_index: other\n",
+			true,
+			nil,
+		},
+		{
+			"invalid option",
+			"read_search_mode: other\n",
+			true,
+			nil,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			writeConfigFile(t, file, c.content)
+			conf, err := loadConfig(testFlags(file), file)
+			if (err != nil) != c.wannaErr {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if c.wannaErr {
+				return
+			}
+			wanna := testFlags(file)
+			c.wannaConf(&wanna)
+			if !reflect.DeepEqual(conf, wanna) {
+				t.Fatalf("unexpected config: %+v, want: %+v", conf, wanna)
+			}
+		})
+	}
+}
+
+func TestConfig_KeepStatic(t *testing.T) {
+	cases := []struct {
+		name         string
+		change       func(c *Config)
+		wannaIgnored []string
+	}{
+		{
+			"dynamic option",
+			func(c *Config) { c.SplunkMetricsIndex = "other" },
+			[]string{},
+		},
+		{
+			"listen address",
+			func(c *Config) { c.ListenAddr = "127.0.0.1:9971" },
+			[]string{"listen_addr"},
+		},
+		{
+			"wal options",
+			func(c *Config) {
+				c.WALDir = "/tmp/wal"
+				c.WALMaxAge = time.Hour
+			},
+			[]string{"wal_dir", "wal_max_age"},
+		},
+		{
+			"admin api",
+			func(c *Config) { c.WebEnableAdminAPI = true },
+			[]string{"web_enable_admin_api"},
+		},
+		{
+			"switching tls on",
+			func(c *Config) {
+				c.WebTLSCertFile = "server.crt"
+				c.WebTLSKeyFile = "server.key"
+			},
+			[]string{"web_tls_cert_file"},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			prev := testFlags("")
+			conf := testFlags("")
+			c.change(&conf)
+			ignored := conf.keepStatic(prev)
+			if !reflect.DeepEqual(ignored, c.wannaIgnored) {
+				t.Fatalf("unexpected ignored options: %v, want: %v", ignored, c.wannaIgnored)
+			}
+			// changes of the ignored options are reverted, the others are kept.
+			wanna := prev
+			if len(c.wannaIgnored) == 0 {
+				c.change(&wanna)
+			}
+			if !reflect.DeepEqual(conf, wanna) {
+				t.Fatalf("unexpected config: %+v, want: %+v", conf, wanna)
+			}
+		})
+	}
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ropee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ropee.yml")
+	writeConfigFile(t, file, "splunk_metrics_index: first\n")
+	flags := testFlags(file)
+	c, err := loadConfig(flags, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := newRuntime(c, nil, nil, test.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &reloader{flags: flags, log: test.Logger(), rt: rt}
+
+	writeConfigFile(t, file, "read_search_mode: other\n")
+	if err := r.reload(); err == nil {
+		t.Fatal("invalid config file reloaded")
+	}
+	if r.current() != rt {
+		t.Fatal("runtime replaced by an invalid config file")
+	}
+
+	writeConfigFile(t, file, "splunk_metrics_index: second\nlisten_addr: 127.0.0.1:9971\n")
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	conf := r.current().config
+	if conf.SplunkMetricsIndex != "second" {
+		t.Fatalf("unexpected index after reload: %s", conf.SplunkMetricsIndex)
+	}
+	if conf.ListenAddr != flags.ListenAddr {
+		t.Fatalf("listen address changed by reload: %s", conf.ListenAddr)
+	}
+}
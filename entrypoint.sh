@@ -2,14 +2,14 @@
 
 CMD="/usr/local/bin/ropee -log-file-path - "
 
-args="splunk-url splunk-hec-url splunk-hec-token listen-addr splunk-metrics-index splunk-metrics-sourcetype timeout debug"
+args="config-file web-enable-admin-api web-tls-cert-file web-tls-key-file web-tls-client-ca-file write-bearer-token write-basic-auth-username write-basic-auth-password splunk-url splunk-hec-url splunk-hec-token splunk-ca-file splunk-server-name splunk-cert-file splunk-key-file splunk-insecure-skip-verify splunk-hec-ca-file splunk-hec-server-name splunk-hec-cert-file splunk-hec-key-file splunk-hec-insecure-skip-verify listen-addr shutdown-grace-period ready-cache-ttl ready-timeout splunk-metrics-index splunk-metrics-sourcetype timeout debug splunk-hec-format splunk-hec-batch-events splunk-hec-batch-bytes retry-max-attempts retry-base-backoff retry-max-backoff retry-jitter retry-status-codes read-aggregation read-metric-aggregations read-raw-max-range read-pushdown-grouping read-query-concurrency read-max-searches read-search-mode read-job-ttl read-max-samples metadata-cache-ttl metadata-cache-size read-cache-size read-cache-bucket read-cache-freshness read-cache-ttl read-cache-dir wal-dir wal-segment-size wal-max-size wal-max-age"
 
 for i in $args
 do
     env_arg=$(echo $i | sed 'y/abcdefghijklmnopqrstuvwxyz-/ABCDEFGHIJKLMNOPQRSTUVWXYZ_/')
     anv_arg_value=$(eval "echo \"\${$env_arg}\"")
     if [ ! -z "$anv_arg_value" ]; then
-        CMD=$CMD"-$i $anv_arg_value "
+        CMD=$CMD"-$i=$anv_arg_value "
     fi
 done
 
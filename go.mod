@@ -13,9 +13,11 @@ require (
 	github.com/lestrrat/go-file-rotatelogs v0.0.0-20180223000712-d3151e2a480f
 	github.com/lestrrat/go-strftime v0.0.0-20180220042222-ba3bf9c1d042 // indirect
 	github.com/prometheus/client_golang v1.2.1
-	github.com/prometheus/prometheus v1.8.2-0.20190818123050-43acd0e2e93f
+	github.com/prometheus/prometheus v1.8.2-0.20191017095924-6f92ce560538
 	github.com/stretchr/testify v1.4.0 // indirect
 	github.com/tebeka/strftime v0.0.0-20140926081919-3f9c7761e312 // indirect
+	gopkg.in/yaml.v2 v2.2.2
+	k8s.io/client-go v12.0.0+incompatible // indirect
 )
 
 replace k8s.io/client-go => k8s.io/client-go v0.0.0-20190620085101-78d2af792bab
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -14,21 +19,61 @@ import (
 	"github.com/golang/snappy"
 	"github.com/kebe7jun/ropee/metrics"
 	"github.com/kebe7jun/ropee/storage"
+	"github.com/kebe7jun/ropee/web"
 	"github.com/lestrrat/go-file-rotatelogs"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/prometheus/prompb"
 )
 
 type Config struct {
-	SplunkUrl               string
-	SplunkMetricsIndex      string
-	SplunkMetricsSourceType string
-	SplunkHECURL            string
-	SplunkHECToken          string
-	TimeoutSeconds          int
-	ListenAddr              string
-	LogFilePath             string
-	Debug                   bool
+	ConfigFile              string            `yaml:"-"`
+	SplunkUrl               string            `yaml:"splunk_url"`
+	SplunkMetricsIndex      string            `yaml:"splunk_metrics_index"`
+	SplunkMetricsSourceType string            `yaml:"splunk_metrics_sourcetype"`
+	SplunkHECURL            string            `yaml:"splunk_hec_url"`
+	SplunkHECToken          string            `yaml:"splunk_hec_token"`
+	SplunkTLS               storage.TLSConfig `yaml:"splunk_tls"`
+	SplunkHECTLS            storage.TLSConfig `yaml:"splunk_hec_tls"`
+	WebEnableAdminAPI       bool              `yaml:"web_enable_admin_api"`
+	WebTLSCertFile          string            `yaml:"web_tls_cert_file"`
+	WebTLSKeyFile           string            `yaml:"web_tls_key_file"`
+	WebTLSClientCAFile      string            `yaml:"web_tls_client_ca_file"`
+	WriteAuth               web.Auth          `yaml:"write_auth"`
+	TimeoutSeconds          int               `yaml:"timeout"`
+	HECFormat               string            `yaml:"splunk_hec_format"`
+	HECBatchMaxEvents       int               `yaml:"splunk_hec_batch_events"`
+	HECBatchMaxBytes        int               `yaml:"splunk_hec_batch_bytes"`
+	RetryMaxAttempts        int               `yaml:"retry_max_attempts"`
+	RetryBaseBackoff        time.Duration     `yaml:"retry_base_backoff"`
+	RetryMaxBackoff         time.Duration     `yaml:"retry_max_backoff"`
+	RetryJitter             float64           `yaml:"retry_jitter"`
+	RetryStatusCodes        string            `yaml:"retry_status_codes"`
+	ReadAggregation         string            `yaml:"read_aggregation"`
+	ReadMetricAggregations  string            `yaml:"read_metric_aggregations"`
+	ReadRawMaxRange         time.Duration     `yaml:"read_raw_max_range"`
+	ReadPushdownGrouping    bool              `yaml:"read_pushdown_grouping"`
+	ReadQueryConcurrency    int               `yaml:"read_query_concurrency"`
+	ReadMaxSearches         int               `yaml:"read_max_searches"`
+	ReadSearchMode          string            `yaml:"read_search_mode"`
+	ReadJobTTL              time.Duration     `yaml:"read_job_ttl"`
+	ReadMaxSamples          int               `yaml:"read_max_samples"`
+	MetadataCacheTTL        time.Duration     `yaml:"metadata_cache_ttl"`
+	MetadataCacheSize       int               `yaml:"metadata_cache_size"`
+	ReadCacheSize           int               `yaml:"read_cache_size"`
+	ReadCacheBucket         time.Duration     `yaml:"read_cache_bucket"`
+	ReadCacheFreshness      time.Duration     `yaml:"read_cache_freshness"`
+	ReadCacheTTL            time.Duration     `yaml:"read_cache_ttl"`
+	ReadCacheDir            string            `yaml:"read_cache_dir"`
+	WALDir                  string            `yaml:"wal_dir"`
+	WALSegmentSize          int64             `yaml:"wal_segment_size"`
+	WALMaxSize              int64             `yaml:"wal_max_size"`
+	WALMaxAge               time.Duration     `yaml:"wal_max_age"`
+	ListenAddr              string            `yaml:"listen_addr"`
+	ShutdownGracePeriod     time.Duration     `yaml:"shutdown_grace_period"`
+	ReadyCacheTTL           time.Duration     `yaml:"ready_cache_ttl"`
+	ReadyTimeout            time.Duration     `yaml:"ready_timeout"`
+	LogFilePath             string            `yaml:"log_file_path"`
+	Debug                   bool              `yaml:"debug"`
 }
 
 var config Config
@@ -62,23 +107,238 @@ func loadLogger() log.Logger {
 
 func initConfig() {
 	// init config
+	flag.StringVar(&config.ConfigFile, "config-file", "", "YAML file overriding the flags, reloaded on SIGHUP or POST /-/reload with -web-enable-admin-api.")
 	flag.StringVar(&config.SplunkUrl, "splunk-url", "https://127.0.0.1:8089", "Splunk Manage Url.")
 	flag.StringVar(&config.SplunkHECURL, "splunk-hec-url", "https://127.0.0.1:8088", "Splunk Http event collector url.")
 	flag.StringVar(&config.SplunkHECToken, "splunk-hec-token", "", "Splunk Http event collector token.")
+	flag.StringVar(&config.SplunkTLS.CAFile, "splunk-ca-file", "", "CA bundle verifying the certificate of -splunk-url, the system CAs are used if empty.")
+	flag.StringVar(&config.SplunkTLS.ServerName, "splunk-server-name", "", "Server name verified in the certificate of -splunk-url instead of its host.")
+	flag.StringVar(&config.SplunkTLS.CertFile, "splunk-cert-file", "", "Client certificate sent to -splunk-url.")
+	flag.StringVar(&config.SplunkTLS.KeyFile, "splunk-key-file", "", "Key of -splunk-cert-file.")
+	flag.BoolVar(&config.SplunkTLS.InsecureSkipVerify, "splunk-insecure-skip-verify", false, "Do not verify the certificate of -splunk-url.")
+	flag.StringVar(&config.SplunkHECTLS.CAFile, "splunk-hec-ca-file", "", "CA bundle verifying the certificate of -splunk-hec-url, the system CAs are used if empty.")
+	flag.StringVar(&config.SplunkHECTLS.ServerName, "splunk-hec-server-name", "", "Server name verified in the certificate of -splunk-hec-url instead of its host.")
+	flag.StringVar(&config.SplunkHECTLS.CertFile, "splunk-hec-cert-file", "", "Client certificate sent to -splunk-hec-url.")
+	flag.StringVar(&config.SplunkHECTLS.KeyFile, "splunk-hec-key-file", "", "Key of -splunk-hec-cert-file.")
+	flag.BoolVar(&config.SplunkHECTLS.InsecureSkipVerify, "splunk-hec-insecure-skip-verify", false, "Do not verify the certificate of -splunk-hec-url.")
 	flag.StringVar(&config.ListenAddr, "listen-addr", "127.0.0.1:9970", "Sopee listen addr.")
+	flag.DurationVar(&config.ReadyCacheTTL, "ready-cache-ttl", 10*time.Second, "How long the result of the splunk probes of /-/ready is cached.")
+	flag.DurationVar(&config.ReadyTimeout, "ready-timeout", 5*time.Second, "Timeout of the splunk probes of /-/ready.")
+	flag.DurationVar(&config.ShutdownGracePeriod, "shutdown-grace-period", 25*time.Second, "Max time to finish in-flight writes and send buffered events on SIGTERM.")
+	flag.BoolVar(&config.WebEnableAdminAPI, "web-enable-admin-api", false, "Enable POST /-/reload and /-/cache/invalidate, protected like /write.")
+	flag.StringVar(&config.WebTLSCertFile, "web-tls-cert-file", "", "Certificate served on -listen-addr, enables https. It is reloaded when the file changes.")
+	flag.StringVar(&config.WebTLSKeyFile, "web-tls-key-file", "", "Key of -web-tls-cert-file.")
+	flag.StringVar(&config.WebTLSClientCAFile, "web-tls-client-ca-file", "", "CA bundle verifying client certificates, which /write requires if set.")
+	flag.StringVar(&config.WriteAuth.BearerToken, "write-bearer-token", "", "Bearer token required on /write.")
+	flag.StringVar(&config.WriteAuth.Username, "write-basic-auth-username", "", "Basic auth username required on /write.")
+	flag.StringVar(&config.WriteAuth.Password, "write-basic-auth-password", "", "Basic auth password required on /write.")
 	flag.StringVar(&config.SplunkMetricsIndex, "splunk-metrics-index", "*", "Index name.")
 	flag.StringVar(&config.SplunkMetricsSourceType, "splunk-metrics-sourcetype", "DaoCloud_promu_metrics", "The prometheus sourcetype name.")
 	flag.StringVar(&config.LogFilePath, "log-file-path", "/var/log", "Log files path.")
 	flag.IntVar(&config.TimeoutSeconds, "timeout", 60, "API timeout seconds.")
+	flag.StringVar(&config.HECFormat, "splunk-hec-format", storage.HECFormatEvent, "Format of written events, event (needs the splunk transforms), metric (native metric events) or multi-metric (one event per label set and timestamp, splunk 8+).")
+	flag.IntVar(&config.HECBatchMaxEvents, "splunk-hec-batch-events", 1000, "Max events sent in one HEC request, 0 means no limit.")
+	flag.IntVar(&config.HECBatchMaxBytes, "splunk-hec-batch-bytes", 1024*1024, "Max body bytes sent in one HEC request, 0 means no limit.")
+	flag.IntVar(&config.RetryMaxAttempts, "retry-max-attempts", storage.DefaultRetryPolicy.MaxAttempts, "Max attempts of one splunk request, 1 means no retry.")
+	flag.DurationVar(&config.RetryBaseBackoff, "retry-base-backoff", storage.DefaultRetryPolicy.BaseBackoff, "Backoff before the first retry, doubled for every next retry.")
+	flag.DurationVar(&config.RetryMaxBackoff, "retry-max-backoff", storage.DefaultRetryPolicy.MaxBackoff, "Max backoff between retries.")
+	flag.Float64Var(&config.RetryJitter, "retry-jitter", storage.DefaultRetryPolicy.Jitter, "Randomized fraction (0-1) of every backoff.")
+	flag.StringVar(&config.RetryStatusCodes, "retry-status-codes", "429,502,503,504", "Comma separated http status codes which are retried.")
+	flag.StringVar(&config.ReadAggregation, "read-aggregation", storage.AggregationLatest, "Default aggregation (latest, avg, max, min, sum) downsampling read series to the query step.")
+	flag.StringVar(&config.ReadMetricAggregations, "read-metric-aggregations", "", "Comma separated metric_pattern=aggregation overriding -read-aggregation, e.g. node_load*=max.")
+	flag.DurationVar(&config.ReadRawMaxRange, "read-raw-max-range", 0, "Queries up to this range return samples at 1s resolution instead of the query step, 0 disables it.")
+	flag.BoolVar(&config.ReadPushdownGrouping, "read-pushdown-grouping", false, "Let splunk compute sum/min/max/avg aggregations from prometheus read hints.")
+	flag.IntVar(&config.ReadQueryConcurrency, "read-query-concurrency", 4, "Max queries of one read request searched in parallel.")
+	flag.IntVar(&config.ReadMaxSearches, "read-max-searches", 16, "Max searches running at the same time for all read requests, 0 means no limit.")
+	flag.StringVar(&config.ReadSearchMode, "read-search-mode", storage.SearchModeJob, "How searches are executed: job (create and poll a job), oneshot or export (stream results).")
+	flag.DurationVar(&config.ReadJobTTL, "read-job-ttl", time.Minute, "How long splunk keeps the artifacts of finished search jobs.")
+	flag.IntVar(&config.ReadMaxSamples, "read-max-samples", 0, "Max samples one query may return, larger queries fail instead of being truncated, 0 means no limit.")
+	flag.DurationVar(&config.MetadataCacheTTL, "metadata-cache-ttl", 5*time.Minute, "How long metric names, dimensions and dimension values from the splunk catalog are cached, 0 disables the cache.")
+	flag.IntVar(&config.MetadataCacheSize, "metadata-cache-size", 10000, "Max catalog lookups cached, the least recently used are evicted beyond it.")
+	flag.IntVar(&config.ReadCacheSize, "read-cache-size", 0, "Max time buckets of query results cached in memory and in -read-cache-dir, 0 disables the results cache.")
+	flag.DurationVar(&config.ReadCacheBucket, "read-cache-bucket", time.Hour, "Time range of one cached bucket of query results, rounded up to a multiple of the query step.")
+	flag.DurationVar(&config.ReadCacheFreshness, "read-cache-freshness", 10*time.Minute, "Buckets newer than this are always searched as splunk may still index samples for them.")
+	flag.DurationVar(&config.ReadCacheTTL, "read-cache-ttl", 24*time.Hour, "How long cached buckets are kept, 0 means until evicted.")
+	flag.StringVar(&config.ReadCacheDir, "read-cache-dir", "", "Directory keeping cached buckets on disk across restarts, empty keeps them in memory only.")
+	flag.StringVar(&config.WALDir, "wal-dir", "", "Directory buffering written events on disk until splunk accepts them, empty disables the buffer.")
+	flag.Int64Var(&config.WALSegmentSize, "wal-segment-size", 64*1024*1024, "Size in bytes of one buffer segment file.")
+	flag.Int64Var(&config.WALMaxSize, "wal-max-size", 1024*1024*1024, "Max size in bytes of the buffer, the oldest segments are dropped beyond it, 0 means no limit.")
+	flag.DurationVar(&config.WALMaxAge, "wal-max-age", 24*time.Hour, "Max age of buffered events, older segments are dropped, 0 means no limit.")
 	flag.BoolVar(&config.Debug, "debug", false, "Debug mode.")
 	flag.Parse()
 }
 
 func main() {
 	initConfig()
+	flags := config
+	c, err := loadConfig(flags, flags.ConfigFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Config error:", err)
+		os.Exit(1)
+	}
+	config = c
 	l := loadLogger()
+	var wal *storage.WAL
+	if config.WALDir != "" {
+		wal, err = storage.OpenWAL(config.WALDir, config.WALSegmentSize, config.WALMaxSize, config.WALMaxAge, l)
+		if err != nil {
+			level.Error(l).Log("msg", "Open wal error", "err", err)
+			os.Exit(1)
+		}
+		defer wal.Close()
+	}
+	rt, err := newRuntime(config, nil, wal, l)
+	if err != nil {
+		level.Error(l).Log("msg", "Config error", "err", err)
+		os.Exit(1)
+	}
+	reloader := &reloader{flags: flags, wal: wal, log: l, rt: rt}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloader.reload()
+		}
+	}()
+	// reads are cancelled when the shutdown starts, which cancels their splunk jobs.
+	readCtx, stopReads := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr: config.ListenAddr,
+		BaseContext: func(net.Listener) context.Context {
+			return readCtx
+		},
+	}
+	stopped := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-term
+		level.Info(l).Log("msg", "shutting down...", "signal", sig)
+		stopReads()
+		shutdown(server, wal, reloader.current().config.ShutdownGracePeriod, l)
+		close(stopped)
+	}()
+	if rt.webTLS != nil {
+		server.TLSConfig = reloader.webTLSConfig()
+	}
 	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/read", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "ropee is healthy.")
+	})
+	http.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := reloader.current().health.Check(r.Context()); err != nil {
+			level.Warn(l).Log("msg", "Not ready", "err", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "ropee is ready.")
+	})
+	// without credentials protect lets everyone in, so the admin endpoints are only served on request.
+	if config.WebEnableAdminAPI {
+		http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+			reloader.current().protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+					return
+				}
+				if err := reloader.reload(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(200)
+			})).ServeHTTP(w, r)
+		})
+		http.HandleFunc("/-/cache/invalidate", func(w http.ResponseWriter, r *http.Request) {
+			rt := reloader.current()
+			// dropping the caches sends every read to splunk, so it needs the write credentials.
+			rt.protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+					return
+				}
+				rt.metadataCache.Invalidate()
+				rt.resultsCache.Invalidate()
+				level.Info(l).Log("msg", "caches invalidated")
+				w.WriteHeader(200)
+			})).ServeHTTP(w, r)
+		})
+	}
+	http.HandleFunc("/read", readHandler(func(user, pass string) storage.RemoteClient {
+		return reloader.current().readClient(user, pass, l)
+	}, l))
+	http.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		rt := reloader.current()
+		rt.protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			compressed, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				level.Error(l).Log("msg", "Read error", "err", err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			reqBuf, err := snappy.Decode(nil, compressed)
+			if err != nil {
+				level.Error(l).Log("msg", "Decode error", "err", err.Error())
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			metrics.WriteRequestCounter.Add(1)
+			var req prompb.WriteRequest
+			if err := proto.Unmarshal(reqBuf, &req); err != nil {
+				level.Error(l).Log("msg", "Unmarshal error", "err", err.Error())
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = rt.writeClient.Write(&req)
+			if err != nil {
+				// prometheus retries 5xx responses and drops the samples on 4xx.
+				status := http.StatusInternalServerError
+				if !storage.IsRecoverable(err) {
+					status = http.StatusBadRequest
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			w.WriteHeader(200)
+			if _, err := w.Write([]byte("ok")); err != nil {
+				level.Error(l).Log("action", "write", "err", err)
+			}
+		})).ServeHTTP(w, r)
+	})
+	level.Info(l).Log("msg", "starting server...", "listen", config.ListenAddr, "tls", server.TLSConfig != nil)
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		level.Error(l).Log("action", "serve", "err", err)
+		return
+	}
+	<-stopped
+}
+
+// shutdown stops accepting requests, waits for in-flight requests and sends the events buffered
+// in the wal within grace, events not sent in time are kept in the wal.
+func shutdown(server *http.Server, wal *storage.WAL, grace time.Duration, l log.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		level.Warn(l).Log("msg", "In-flight requests not finished", "err", err)
+	}
+	if wal == nil {
+		return
+	}
+	if err := wal.Drain(ctx); err != nil {
+		level.Warn(l).Log("msg", "Buffered events not sent, they are replayed on start", "err", err)
+	}
+}
+
+// readHandler serves remote read requests with the clients newClient creates from the request credentials.
+func readHandler(newClient func(user, pass string) storage.RemoteClient, l log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			level.Error(l).Log("msg", "Read error", "err", err.Error())
@@ -99,20 +359,31 @@ func main() {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		responseType, err := storage.NegotiateResponseType(req.AcceptedResponseTypes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		user, pass, _ := r.BasicAuth()
-		readClient, _ := storage.NewClient(
-			config.SplunkUrl,
-			user,
-			pass,
-			config.SplunkMetricsIndex,
-			config.SplunkMetricsSourceType,
-			config.SplunkHECURL, config.SplunkHECToken,
-			time.Second*time.Duration(config.TimeoutSeconds),
-			l,
-		)
-		resp, err := readClient.Read(&req)
+		readClient := newClient(user, pass)
+		if responseType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+			cw := storage.NewChunkedWriter(w)
+			if err := readClient.ReadChunked(r.Context(), &req, cw); err != nil {
+				// The status is sent with the first frame, later errors abort the connection so
+				// that prometheus does not take the frames sent so far for the complete result.
+				if cw.Frames() == 0 {
+					http.Error(w, err.Error(), readErrorStatus(err))
+					return
+				}
+				level.Warn(l).Log("msg", "Error streaming query results", "err", err)
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+		resp, err := readClient.Read(r.Context(), &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), readErrorStatus(err))
 			return
 		}
 
@@ -131,50 +402,12 @@ func main() {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-	})
-	writeClient, _ := storage.NewClient(
-		config.SplunkUrl,
-		"",
-		"",
-		config.SplunkMetricsIndex,
-		config.SplunkMetricsSourceType,
-		config.SplunkHECURL, config.SplunkHECToken,
-		time.Second*time.Duration(config.TimeoutSeconds),
-		l,
-	)
-	http.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
-		compressed, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			level.Error(l).Log("msg", "Read error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	}
+}
 
-		reqBuf, err := snappy.Decode(nil, compressed)
-		if err != nil {
-			level.Error(l).Log("msg", "Decode error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		metrics.WriteRequestCounter.Add(1)
-		var req prompb.WriteRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			level.Error(l).Log("msg", "Unmarshal error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		err = writeClient.Write(&req)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(200)
-		if _, err := w.Write([]byte("ok")); err != nil {
-			level.Error(l).Log("action", "write", "err", err)
-		}
-	})
-	level.Info(l).Log("msg", "starting server...", "listen", config.ListenAddr)
-	if err := http.ListenAndServe(config.ListenAddr, nil); err != nil {
-		level.Error(l).Log("action", "serve", "err", err)
+func readErrorStatus(err error) int {
+	if _, ok := err.(*storage.TooManySamplesError); ok {
+		return http.StatusUnprocessableEntity
 	}
+	return http.StatusInternalServerError
 }
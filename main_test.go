@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/kebe7jun/ropee/storage"
+	"github.com/kebe7jun/ropee/test"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestReadHandler_AbortsFailedStream(t *testing.T) {
+	// the search of metric "fail" is rejected, the other one returns a row.
+	splunk := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(bs))
+		switch {
+		case r.URL.Path != "/services/search/jobs":
+			w.Write([]byte(`{"entry":[]}`))
+		case strings.Contains(form.Get("search"), "fail"):
+			http.Error(w, "search failed", http.StatusBadRequest)
+		default:
+			w.Write([]byte(`{"fields":["ropee_metric_name","_time","ropee_metric_value"],"rows":[["ok","1","1"]]}`))
+		}
+	}))
+	defer splunk.Close()
+	newClient := func(user, pass string) storage.RemoteClient {
+		c, _ := storage.NewClient(splunk.URL, user, pass, "test", "", "", "", time.Second, test.Logger(),
+			storage.WithSearchMode(storage.SearchModeOneshot),
+			// one query at a time, so that the result of the first one is sent before the second fails.
+			storage.WithQueryConcurrency(1, nil),
+		)
+		return c
+	}
+	server := httptest.NewServer(readHandler(newClient, test.Logger()))
+	defer server.Close()
+
+	query := func(name string) *prompb.Query {
+		return &prompb.Query{
+			StartTimestampMs: 0,
+			EndTimestampMs:   10000,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: name},
+			},
+			Hints: &prompb.ReadHints{},
+		}
+	}
+	data, _ := proto.Marshal(&prompb.ReadRequest{
+		Queries:               []*prompb.Query{query("ok"), query("fail")},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+	})
+	resp, err := http.Post(server.URL, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if len(body) == 0 {
+		t.Fatal("no frames of the first query received")
+	}
+	if err == nil {
+		t.Fatal("stream ended cleanly after a failed query, want an aborted connection")
+	}
+}
@@ -29,6 +29,62 @@ var (
 			Name: "ropee_splunk_events_wrote_failed_count",
 		},
 	)
+	SplunkRequestRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_splunk_request_retries_count",
+		},
+		[]string{"type"},
+	)
+	SplunkJobsCancelled = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_splunk_jobs_cancelled_count",
+		},
+	)
+	WALSegments = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_wal_segments",
+	})
+	WALSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_wal_size_bytes",
+	})
+	WALPendingEvents = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_wal_pending_events",
+	})
+	WALDroppedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_wal_dropped_events_count",
+		},
+	)
+	MetadataCacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_metadata_cache_hits_count",
+		},
+		[]string{"type"},
+	)
+	MetadataCacheMisses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_metadata_cache_misses_count",
+		},
+		[]string{"type"},
+	)
+	MetadataCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_metadata_cache_entries",
+	})
+	ResultsCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_results_cache_hits_count",
+		},
+	)
+	ResultsCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_results_cache_misses_count",
+		},
+	)
+	ResultsCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_results_cache_entries",
+	})
+	SplunkUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ropee_splunk_up",
+	}, []string{"endpoint"})
 	uptime = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ropee_uptime",
 	})
@@ -40,6 +96,19 @@ func init() {
 	prometheus.MustRegister(SplunkJobLatency)
 	prometheus.MustRegister(SplunkEventsWrote)
 	prometheus.MustRegister(SplunkEventsWroteFailed)
+	prometheus.MustRegister(SplunkRequestRetries)
+	prometheus.MustRegister(SplunkJobsCancelled)
+	prometheus.MustRegister(WALSegments)
+	prometheus.MustRegister(WALSizeBytes)
+	prometheus.MustRegister(WALPendingEvents)
+	prometheus.MustRegister(WALDroppedEvents)
+	prometheus.MustRegister(MetadataCacheHits)
+	prometheus.MustRegister(MetadataCacheMisses)
+	prometheus.MustRegister(MetadataCacheEntries)
+	prometheus.MustRegister(ResultsCacheHits)
+	prometheus.MustRegister(ResultsCacheMisses)
+	prometheus.MustRegister(ResultsCacheEntries)
+	prometheus.MustRegister(SplunkUp)
 	prometheus.MustRegister(uptime)
 	uptime.SetToCurrentTime()
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/storage"
+	"github.com/kebe7jun/ropee/web"
+)
+
+// runtime holds everything built from one config, it is replaced as a whole on reload
+// so that a request always sees a consistent config.
+type runtime struct {
+	config         Config
+	retry          storage.RetryPolicy
+	readOpts       storage.ReadOptions
+	restHTTPClient *http.Client
+	hecHTTPClient  *http.Client
+	webTLS         *tls.Config
+	queryLimiter   storage.QueryLimiter
+	metadataCache  *storage.MetadataCache
+	resultsCache   *storage.ResultsCache
+	writeClient    storage.RemoteClient
+	health         *storage.HealthChecker
+}
+
+// newRuntime builds the runtime of c, the query limiter and caches of prev are kept
+// if their options did not change. wal is shared by all write clients.
+func newRuntime(c Config, prev *runtime, wal *storage.WAL, l log.Logger) (*runtime, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	rt := &runtime{
+		config:   c,
+		readOpts: c.readOptions(),
+	}
+	rt.retry, _ = c.retryPolicy()
+	var err error
+	if rt.restHTTPClient, err = storage.NewHTTPClient(c.SplunkTLS); err != nil {
+		return nil, err
+	}
+	if rt.hecHTTPClient, err = storage.NewHTTPClient(c.SplunkHECTLS); err != nil {
+		return nil, err
+	}
+	if c.webTLSEnabled() {
+		if rt.webTLS, err = web.TLSConfig(c.WebTLSCertFile, c.WebTLSKeyFile, c.WebTLSClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if prev != nil && prev.config.ReadMaxSearches == c.ReadMaxSearches {
+		rt.queryLimiter = prev.queryLimiter
+	} else {
+		rt.queryLimiter = storage.NewQueryLimiter(c.ReadMaxSearches)
+	}
+	if prev != nil && prev.config.MetadataCacheTTL == c.MetadataCacheTTL && prev.config.MetadataCacheSize == c.MetadataCacheSize {
+		rt.metadataCache = prev.metadataCache
+	} else if c.MetadataCacheTTL > 0 {
+		rt.metadataCache = storage.NewMetadataCache(c.MetadataCacheSize, c.MetadataCacheTTL)
+	}
+	if prev != nil && prev.config.ReadCacheSize == c.ReadCacheSize && prev.config.ReadCacheBucket == c.ReadCacheBucket &&
+		prev.config.ReadCacheFreshness == c.ReadCacheFreshness && prev.config.ReadCacheTTL == c.ReadCacheTTL &&
+		prev.config.ReadCacheDir == c.ReadCacheDir {
+		rt.resultsCache = prev.resultsCache
+	} else if c.ReadCacheSize > 0 {
+		rt.resultsCache, err = storage.NewResultsCache(c.ReadCacheSize, c.ReadCacheBucket,
+			c.ReadCacheFreshness, c.ReadCacheTTL, c.ReadCacheDir, l)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rt.health = storage.NewHealthChecker(c.SplunkUrl, c.SplunkHECURL, rt.restHTTPClient, rt.hecHTTPClient,
+		c.ReadyCacheTTL, c.ReadyTimeout)
+
+	writeOpts := []storage.ClientOption{
+		storage.WithBatchSize(c.HECBatchMaxEvents, c.HECBatchMaxBytes),
+		storage.WithRetryPolicy(rt.retry),
+		storage.WithHTTPClients(rt.restHTTPClient, rt.hecHTTPClient),
+		storage.WithHECFormat(c.HECFormat),
+	}
+	if wal != nil {
+		// the wal replays with the client created last.
+		writeOpts = append(writeOpts, storage.WithWAL(wal))
+	}
+	rt.writeClient, err = storage.NewClient(
+		c.SplunkUrl,
+		"",
+		"",
+		c.SplunkMetricsIndex,
+		c.SplunkMetricsSourceType,
+		c.SplunkHECURL, c.SplunkHECToken,
+		time.Second*time.Duration(c.TimeoutSeconds),
+		l,
+		writeOpts...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// readClient returns a client searching splunk with the credentials of a read request.
+func (rt *runtime) readClient(user, pass string, l log.Logger) storage.RemoteClient {
+	c := rt.config
+	readClient, _ := storage.NewClient(
+		c.SplunkUrl,
+		user,
+		pass,
+		c.SplunkMetricsIndex,
+		c.SplunkMetricsSourceType,
+		c.SplunkHECURL, c.SplunkHECToken,
+		time.Second*time.Duration(c.TimeoutSeconds),
+		l,
+		storage.WithRetryPolicy(rt.retry),
+		storage.WithHTTPClients(rt.restHTTPClient, rt.hecHTTPClient),
+		storage.WithReadOptions(rt.readOpts),
+		storage.WithQueryConcurrency(c.ReadQueryConcurrency, rt.queryLimiter),
+		storage.WithSearchMode(c.ReadSearchMode),
+		storage.WithJobTTL(c.ReadJobTTL),
+		storage.WithMaxSamples(c.ReadMaxSamples),
+		storage.WithMetadataCache(rt.metadataCache),
+		storage.WithResultsCache(rt.resultsCache),
+	)
+	return readClient
+}
+
+// protect wraps h with the client certificate check, if client CAs are configured, and the write credentials.
+func (rt *runtime) protect(h http.Handler) http.Handler {
+	h = rt.config.WriteAuth.Wrap(h)
+	if rt.webTLS != nil && rt.webTLS.ClientCAs != nil {
+		h = web.RequireClientCert(h)
+	}
+	return h
+}
+
+// reloader owns the current runtime and replaces it when the config file is reloaded.
+type reloader struct {
+	// flags is the config from the command line which the config file overrides.
+	flags Config
+	wal   *storage.WAL
+	log   log.Logger
+
+	mtx sync.RWMutex
+	rt  *runtime
+}
+
+func (r *reloader) current() *runtime {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.rt
+}
+
+// reload reads the config file again, on errors the running config is kept.
+func (r *reloader) reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	c, err := loadConfig(r.flags, r.flags.ConfigFile)
+	if err != nil {
+		level.Error(r.log).Log("msg", "Reload config error", "err", err)
+		return err
+	}
+	if ignored := c.keepStatic(r.rt.config); len(ignored) > 0 {
+		level.Warn(r.log).Log("msg", "Changed options need a restart", "options", strings.Join(ignored, ","))
+	}
+	rt, err := newRuntime(c, r.rt, r.wal, r.log)
+	if err != nil {
+		level.Error(r.log).Log("msg", "Reload config error", "err", err)
+		return err
+	}
+	r.rt = rt
+	level.Info(r.log).Log("msg", "Config reloaded", "file", r.flags.ConfigFile)
+	return nil
+}
+
+// webTLSConfig returns a server config using the web TLS config of the current runtime,
+// so that certificate changes apply to new connections.
+func (r *reloader) webTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.current().webTLS.GetCertificate(hello)
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current().webTLS, nil
+		},
+	}
+}
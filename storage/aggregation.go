@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Aggregations supported by mstats for downsampling a series to the query step.
+const (
+	AggregationLatest = "latest"
+	AggregationAvg    = "avg"
+	AggregationMax    = "max"
+	AggregationMin    = "min"
+	AggregationSum    = "sum"
+)
+
+var aggregations = map[string]bool{
+	AggregationLatest: true,
+	AggregationAvg:    true,
+	AggregationMax:    true,
+	AggregationMin:    true,
+	AggregationSum:    true,
+}
+
+// hintAggregations maps functions from prometheus read hints to the downsampling
+// aggregation which keeps their result correct.
+var hintAggregations = map[string]string{
+	"max_over_time": AggregationMax,
+	"min_over_time": AggregationMin,
+	"avg_over_time": AggregationAvg,
+	"sum_over_time": AggregationSum,
+	"max":           AggregationMax,
+	"min":           AggregationMin,
+}
+
+// MetricAggregation sets the default aggregation of the metrics matching Pattern (a shell glob).
+type MetricAggregation struct {
+	Pattern     string
+	Aggregation string
+}
+
+// ReadOptions configures how MakeSPL renders mstats searches.
+type ReadOptions struct {
+	// DefaultAggregation is used when neither hints nor MetricAggregations select one, latest if empty.
+	DefaultAggregation string
+	// MetricAggregations are checked in order, the first matching pattern wins.
+	MetricAggregations []MetricAggregation
+	// RawMaxRangeMs is the longest query range returning samples at one second resolution
+	// instead of the query step, 0 disables it.
+	RawMaxRangeMs int64
+	// PushdownGrouping lets splunk compute sum, min, max and avg aggregations from read hints.
+	PushdownGrouping bool
+}
+
+// WithReadOptions sets the options of rendered searches.
+func WithReadOptions(opts ReadOptions) ClientOption {
+	return func(c *Client) {
+		c.readOpts = opts
+	}
+}
+
+// ParseMetricAggregations parses a comma separated list of `pattern=aggregation`.
+func ParseMetricAggregations(s string) ([]MetricAggregation, error) {
+	res := make([]MetricAggregation, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid metric aggregation %q, want pattern=aggregation", item)
+		}
+		if _, err := path.Match(kv[0], ""); err != nil {
+			return nil, fmt.Errorf("invalid metric pattern %q: %s", kv[0], err)
+		}
+		if !aggregations[kv[1]] {
+			return nil, fmt.Errorf("unsupported aggregation %q", kv[1])
+		}
+		res = append(res, MetricAggregation{Pattern: kv[0], Aggregation: kv[1]})
+	}
+	return res, nil
+}
+
+// ValidAggregation reports whether mstats supports agg for downsampling.
+func ValidAggregation(agg string) bool {
+	return aggregations[agg]
+}
+
+// aggregation selects the downsampling function of a query, metricName is empty
+// when the query selects more than one metric.
+func (o ReadOptions) aggregation(metricName string, hints *prompb.ReadHints) string {
+	if hints != nil {
+		if agg, ok := hintAggregations[hints.Func]; ok {
+			return agg
+		}
+	}
+	if metricName != "" {
+		for _, ma := range o.MetricAggregations {
+			if ok, _ := path.Match(ma.Pattern, metricName); ok {
+				return ma.Aggregation
+			}
+		}
+	}
+	if o.DefaultAggregation != "" {
+		return o.DefaultAggregation
+	}
+	return AggregationLatest
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/kebe7jun/ropee/metrics"
+)
+
+// MetadataCache caches splunk catalog lookups (metric names, metric dimensions and dimension values)
+// for all clients. Entries expire after ttl, the least recently used entries are evicted beyond size.
+// A nil *MetadataCache caches nothing.
+type MetadataCache struct {
+	entries *lruCache
+}
+
+func NewMetadataCache(size int, ttl time.Duration) *MetadataCache {
+	return &MetadataCache{
+		entries: newLRUCache(size, ttl, func(n int) {
+			metrics.MetadataCacheEntries.Set(float64(n))
+		}),
+	}
+}
+
+// get returns a copy of the cached values of key, kind labels the hit and miss metrics.
+func (c *MetadataCache) get(kind, key string) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	if v, ok := c.entries.get(key); ok {
+		metrics.MetadataCacheHits.WithLabelValues(kind).Inc()
+		return append([]string(nil), v.([]string)...), true
+	}
+	metrics.MetadataCacheMisses.WithLabelValues(kind).Inc()
+	return nil, false
+}
+
+func (c *MetadataCache) set(key string, values []string) {
+	if c == nil {
+		return
+	}
+	c.entries.set(key, append([]string(nil), values...))
+}
+
+// Invalidate removes all entries, e.g. after new metrics or dimensions were indexed.
+func (c *MetadataCache) Invalidate() {
+	if c == nil {
+		return
+	}
+	c.entries.purge()
+}
+
+// Len returns the number of cached entries, expired entries included.
+func (c *MetadataCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	return c.entries.len()
+}
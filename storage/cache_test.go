@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kebe7jun/ropee/test"
+)
+
+func TestMetadataCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewMetadataCache(2, time.Minute)
+	c.entries.now = func() time.Time { return now }
+
+	c.set("a", []string{"1"})
+	c.set("b", []string{"2"})
+	if v, ok := c.get("test", "a"); !ok || !reflect.DeepEqual(v, []string{"1"}) {
+		t.Fatalf("unexpected a: %v, %v", v, ok)
+	}
+	c.set("c", []string{"3"})
+	if _, ok := c.get("test", "b"); ok {
+		t.Fatal("least recently used entry not evicted")
+	}
+	if _, ok := c.get("test", "a"); !ok {
+		t.Fatal("recently used entry evicted")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("test", "c"); ok {
+		t.Fatal("expired entry returned")
+	}
+	if c.Len() != 1 {
+		t.Fatalf("unexpected len: %d, want: 1", c.Len())
+	}
+	c.Invalidate()
+	if _, ok := c.get("test", "a"); ok || c.Len() != 0 {
+		t.Fatal("entries left after invalidate")
+	}
+
+	var nilCache *MetadataCache
+	nilCache.set("a", []string{"1"})
+	if _, ok := nilCache.get("test", "a"); ok {
+		t.Fatal("nil cache returned an entry")
+	}
+}
+
+func TestClient_MetadataCache(t *testing.T) {
+	cases := []struct {
+		name          string
+		status        int
+		body          string
+		wannaLabels   []string
+		wannaRequests int
+	}{
+		{
+			"cached",
+			200,
+			`{"entry":[{"name":"instance"},{"name":"source"},{"name":"job"}]}`,
+			[]string{"instance", "job"},
+			1,
+		},
+		{
+			"error not cached",
+			401,
+			`{"messages":[{"type":"WARN","text":"call not properly authenticated"}]}`,
+			[]string{},
+			2,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fc := &routeClient{routes: []route{
+				{"GET", "/dimensions", reply(c.status, c.body)},
+			}}
+			cache := NewMetadataCache(10, time.Minute)
+			client := Client{
+				url:           "http://test.com",
+				user:          "admin",
+				client:        fc,
+				index:         "test",
+				timeout:       time.Second,
+				log:           test.Logger(),
+				metadataCache: cache,
+			}
+			for j := 0; j < 2; j++ {
+				if labels := client.MetricLabels(context.Background(), "up"); !reflect.DeepEqual(labels, c.wannaLabels) {
+					t.Fatalf("unexpected labels: %v, want: %v", labels, c.wannaLabels)
+				}
+			}
+			if fc.count() != c.wannaRequests {
+				t.Fatalf("unexpected requests: %d, want: %d", fc.count(), c.wannaRequests)
+			}
+			other := client
+			other.user = "other"
+			other.MetricLabels(context.Background(), "up")
+			if fc.count() != c.wannaRequests+1 {
+				t.Fatal("cache shared between users")
+			}
+		})
+	}
+}
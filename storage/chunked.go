@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+const (
+	// maxSamplesInChunk is the number of samples in one XOR chunk, the same as prometheus uses.
+	maxSamplesInChunk = 120
+	// maxFrameBytes is the approximate size of chunks sent in one frame of a streamed response.
+	maxFrameBytes = 1024 * 1024
+)
+
+var chunkedCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// NegotiateResponseType returns the first response type of accepted which ropee supports,
+// prometheus before 2.13 sends no accepted types and expects SAMPLES.
+func NegotiateResponseType(accepted []prompb.ReadRequest_ResponseType) (prompb.ReadRequest_ResponseType, error) {
+	if len(accepted) == 0 {
+		return prompb.ReadRequest_SAMPLES, nil
+	}
+	for _, t := range accepted {
+		switch t {
+		case prompb.ReadRequest_SAMPLES, prompb.ReadRequest_STREAMED_XOR_CHUNKS:
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("no supported response type in %v", accepted)
+}
+
+// ChunkedWriter writes the frames of a STREAMED_XOR_CHUNKS remote read response.
+// Every frame is the uvarint size and the crc32 (Castagnoli) of a marshaled
+// ChunkedReadResponse followed by the message, frames are flushed immediately.
+type ChunkedWriter struct {
+	mtx        sync.Mutex
+	w          io.Writer
+	frames     int
+	frameBytes int
+}
+
+func NewChunkedWriter(w io.Writer) *ChunkedWriter {
+	return &ChunkedWriter{w: w, frameBytes: maxFrameBytes}
+}
+
+// Frames returns the number of frames written, no response status can be sent after the first one.
+func (w *ChunkedWriter) Frames() int {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.frames
+}
+
+// writeFrame writes one frame, w.mtx must be held.
+func (w *ChunkedWriter) writeFrame(resp *prompb.ChunkedReadResponse) error {
+	data, err := proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutUvarint(header, uint64(len(data)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(data, chunkedCastagnoli))
+
+	if _, err := w.w.Write(header[:n+4]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.frames++
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// writeQueryResult encodes the series of res as XOR chunks, series are sent in label order,
+// one series per frame and split over several frames when its chunks exceed frameBytes.
+// The whole result is written at once, as no frame of another series may come between
+// the frames of a split series.
+func (w *ChunkedWriter) writeQueryResult(queryIndex int64, res *prompb.QueryResult) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	sort.Slice(res.Timeseries, func(i, j int) bool {
+		return compareLabels(res.Timeseries[i].Labels, res.Timeseries[j].Labels) < 0
+	})
+	for _, ts := range res.Timeseries {
+		labelsSize := 0
+		for _, l := range ts.Labels {
+			labelsSize += l.Size()
+		}
+		samples := ts.Samples
+		for len(samples) > 0 {
+			var chunks []prompb.Chunk
+			chunks, samples = encodeChunks(samples, w.frameBytes-labelsSize)
+			err := w.writeFrame(&prompb.ChunkedReadResponse{
+				ChunkedSeries: []*prompb.ChunkedSeries{
+					{
+						Labels: ts.Labels,
+						Chunks: chunks,
+					},
+				},
+				QueryIndex: queryIndex,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeChunks encodes samples into chunks until frameBytes are used, it returns the samples left.
+func encodeChunks(samples []prompb.Sample, frameBytes int) ([]prompb.Chunk, []prompb.Sample) {
+	chunks := make([]prompb.Chunk, 0)
+	for len(samples) > 0 && frameBytes > 0 {
+		n := len(samples)
+		if n > maxSamplesInChunk {
+			n = maxSamplesInChunk
+		}
+		chk := chunkenc.NewXORChunk()
+		app, _ := chk.Appender()
+		for _, s := range samples[:n] {
+			app.Append(s.Timestamp, s.Value)
+		}
+		chunks = append(chunks, prompb.Chunk{
+			MinTimeMs: samples[0].Timestamp,
+			MaxTimeMs: samples[n-1].Timestamp,
+			Type:      prompb.Chunk_XOR,
+			Data:      chk.Bytes(),
+		})
+		frameBytes -= chunks[len(chunks)-1].Size()
+		samples = samples[n:]
+	}
+	return chunks, samples
+}
+
+func compareLabels(a, b []prompb.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			if a[i].Name < b[i].Name {
+				return -1
+			}
+			return 1
+		}
+		if a[i].Value != b[i].Value {
+			if a[i].Value < b[i].Value {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// ReadChunked runs the queries of req like Read, but writes every query result to w as soon as its
+// search is done instead of after all queries are done. Streaming is per query, the rows of every
+// search are still buffered until it is done and only then encoded as chunks.
+func (c *Client) ReadChunked(ctx context.Context, req *prompb.ReadRequest, w *ChunkedWriter) error {
+	return c.runQueries(ctx, req.Queries, func(i int, res *prompb.QueryResult) error {
+		return w.writeQueryResult(int64(i), res)
+	})
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/kebe7jun/ropee/test"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+func readFrames(t *testing.T, b []byte) []prompb.ChunkedReadResponse {
+	r := bufio.NewReader(bytes.NewReader(b))
+	frames := make([]prompb.ChunkedReadResponse, 0)
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum uint32
+		if err := binary.Read(r, binary.BigEndian, &sum); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		if crc32.Checksum(data, chunkedCastagnoli) != sum {
+			t.Fatalf("checksum mismatch of frame %d", len(frames))
+		}
+		var resp prompb.ChunkedReadResponse
+		if err := proto.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, resp)
+	}
+}
+
+func TestClient_ReadChunked(t *testing.T) {
+	query := &prompb.Query{
+		StartTimestampMs: 0,
+		EndTimestampMs:   10,
+		Matchers: []*prompb.LabelMatcher{
+			{
+				Type:  prompb.LabelMatcher_EQ,
+				Name:  "__name__",
+				Value: "test",
+			},
+		},
+		Hints: &prompb.ReadHints{},
+	}
+	req := prompb.ReadRequest{
+		Queries:               []*prompb.Query{query, query},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+	}
+	fs := &fakeSplunk{rows: sampleRows(250)}
+	client := Client{
+		url:     "http://test.com",
+		client:  fs.client(),
+		index:   "test",
+		timeout: time.Second,
+		log:     test.Logger(),
+	}
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf)
+	if err := client.ReadChunked(context.Background(), &req, w); err != nil {
+		t.Fatal(err)
+	}
+	frames := readFrames(t, buf.Bytes())
+	if len(frames) != 2 || w.Frames() != 2 {
+		t.Fatalf("unexpected frames: %d, want: 2", len(frames))
+	}
+	seen := make(map[int64]bool)
+	for _, f := range frames {
+		seen[f.QueryIndex] = true
+		if len(f.ChunkedSeries) != 1 || len(f.ChunkedSeries[0].Chunks) != 3 {
+			t.Fatalf("unexpected series: %v", f.ChunkedSeries)
+		}
+		if f.ChunkedSeries[0].Labels[0].Value != "test" {
+			t.Fatalf("unexpected labels: %v", f.ChunkedSeries[0].Labels)
+		}
+		var ts int64
+		for _, chk := range f.ChunkedSeries[0].Chunks {
+			c, err := chunkenc.FromData(chunkenc.EncXOR, chk.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			it := c.Iterator(nil)
+			for it.Next() {
+				got, v := it.At()
+				if got != ts*1000 || v != 1 {
+					t.Fatalf("unexpected sample: %d %f, want: %d 1", got, v, ts*1000)
+				}
+				ts++
+			}
+			if chk.MaxTimeMs != (ts-1)*1000 {
+				t.Fatalf("unexpected chunk max time: %d", chk.MaxTimeMs)
+			}
+		}
+		if ts != 250 {
+			t.Fatalf("unexpected samples: %d, want: 250", ts)
+		}
+	}
+	if !seen[0] || !seen[1] {
+		t.Fatalf("unexpected query indexes: %v", seen)
+	}
+}
+
+// slowWriter delays every write, so that frames of concurrent queries would interleave.
+type slowWriter struct {
+	bytes.Buffer
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return w.Buffer.Write(b)
+}
+
+func TestClient_ReadChunkedSplitSeries(t *testing.T) {
+	query := &prompb.Query{
+		EndTimestampMs: 10,
+		Matchers: []*prompb.LabelMatcher{
+			{
+				Type:  prompb.LabelMatcher_EQ,
+				Name:  "__name__",
+				Value: "test",
+			},
+		},
+		Hints: &prompb.ReadHints{},
+	}
+	req := prompb.ReadRequest{
+		Queries: []*prompb.Query{query, query},
+	}
+	fs := &fakeSplunk{rows: sampleRows(250)}
+	client := Client{
+		url:              "http://test.com",
+		client:           fs.client(),
+		index:            "test",
+		timeout:          time.Second,
+		queryConcurrency: 2,
+		log:              test.Logger(),
+	}
+	var buf slowWriter
+	w := NewChunkedWriter(&buf)
+	// one chunk per frame, every series is split over 3 frames.
+	w.frameBytes = (&prompb.Label{Name: "__name__", Value: "test"}).Size() + 1
+	if err := client.ReadChunked(context.Background(), &req, w); err != nil {
+		t.Fatal(err)
+	}
+	frames := readFrames(t, buf.Bytes())
+	if len(frames) != 6 {
+		t.Fatalf("unexpected frames: %d, want: 6", len(frames))
+	}
+	// the series of a query is done once a frame of the other query was sent.
+	done := make(map[int64]bool)
+	for i, f := range frames {
+		if done[f.QueryIndex] {
+			t.Fatalf("frame %d continues the series of query %d after another series started", i, f.QueryIndex)
+		}
+		if i > 0 && frames[i-1].QueryIndex != f.QueryIndex {
+			done[frames[i-1].QueryIndex] = true
+		}
+	}
+}
+
+func TestEncodeChunks(t *testing.T) {
+	samples := make([]prompb.Sample, 250)
+	for i := range samples {
+		samples[i] = prompb.Sample{Timestamp: int64(i), Value: float64(i)}
+	}
+	cases := []struct {
+		frameBytes  int
+		wannaChunks int
+		wannaLeft   int
+	}{
+		{maxFrameBytes, 3, 0},
+		{1, 1, 130},
+	}
+	for i, c := range cases {
+		chunks, left := encodeChunks(samples, c.frameBytes)
+		if len(chunks) != c.wannaChunks || len(left) != c.wannaLeft {
+			t.Fatalf("test-%d: unexpected chunks: %d, left: %d, want: %d, %d", i, len(chunks), len(left), c.wannaChunks, c.wannaLeft)
+		}
+	}
+}
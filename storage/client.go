@@ -3,8 +3,8 @@ package storage
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,6 +13,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -22,10 +23,11 @@ import (
 )
 
 type RemoteClient interface {
-	Read(*prompb.ReadRequest) (*prompb.ReadResponse, error)
+	Read(context.Context, *prompb.ReadRequest) (*prompb.ReadResponse, error)
+	ReadChunked(context.Context, *prompb.ReadRequest, *ChunkedWriter) error
 	Write(*prompb.WriteRequest) error
-	MetricLabels(string) []string
-	LabelValues(string) []string
+	MetricLabels(context.Context, string) []string
+	LabelValues(context.Context, string) []string
 }
 
 type HTTPClient interface {
@@ -37,131 +39,413 @@ type Client struct {
 	user             string
 	password         string
 	client           HTTPClient
+	hecClient        HTTPClient
 	timeout          time.Duration
 	index            string
 	hecUrl, hecToken string
 	sourcetype       string
 	log              log.Logger
+	// batchMaxEvents and batchMaxBytes limit a single HEC request, 0 means no limit.
+	batchMaxEvents int
+	batchMaxBytes  int
+	retry          RetryPolicy
+	wal            *WAL
+	hecFormat      string
+	readOpts       ReadOptions
+	// queryConcurrency limits the parallel searches of one read request,
+	// queryLimiter those of all clients sharing it.
+	queryConcurrency int
+	queryLimiter     QueryLimiter
+	searchMode       string
+	jobTTL           time.Duration
+	maxSamples       int
+	metadataCache    *MetadataCache
+	resultsCache     *ResultsCache
+}
+
+// ClientOption configures optional behaviours of Client.
+type ClientOption func(*Client)
+
+// WithBatchSize limits how many events and how many body bytes are sent in one HEC request.
+func WithBatchSize(maxEvents, maxBytes int) ClientOption {
+	return func(c *Client) {
+		c.batchMaxEvents = maxEvents
+		c.batchMaxBytes = maxBytes
+	}
+}
+
+// WithWAL buffers written events in w, Write returns once the events are persisted
+// and they are replayed to HEC in the background.
+func WithWAL(w *WAL) ClientOption {
+	return func(c *Client) {
+		c.wal = w
+	}
+}
+
+// WithHECFormat selects how written events are encoded, HECFormatEvent, HECFormatMetric or HECFormatMultiMetric.
+func WithHECFormat(format string) ClientOption {
+	return func(c *Client) {
+		c.hecFormat = format
+	}
+}
+
+// QueryLimiter limits the searches running at the same time, a nil QueryLimiter has no limit.
+type QueryLimiter chan struct{}
+
+// NewQueryLimiter creates a QueryLimiter allowing n searches, n < 1 means no limit.
+func NewQueryLimiter(n int) QueryLimiter {
+	if n < 1 {
+		return nil
+	}
+	return make(QueryLimiter, n)
+}
+
+// acquire waits for a free search slot until ctx is done.
+func (l QueryLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l QueryLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// WithQueryConcurrency runs up to perRequest queries of a read request in parallel,
+// limiter is shared between clients to bound the searches of all requests.
+func WithQueryConcurrency(perRequest int, limiter QueryLimiter) ClientOption {
+	return func(c *Client) {
+		c.queryConcurrency = perRequest
+		c.queryLimiter = limiter
+	}
+}
+
+// WithSearchMode selects how searches are executed, SearchModeJob, SearchModeOneshot or SearchModeExport.
+func WithSearchMode(mode string) ClientOption {
+	return func(c *Client) {
+		c.searchMode = mode
+	}
+}
+
+// WithJobTTL sets how long splunk keeps the artifacts of finished search jobs.
+func WithJobTTL(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.jobTTL = ttl
+	}
+}
+
+// WithMaxSamples limits how many samples one query may return, 0 means no limit.
+func WithMaxSamples(n int) ClientOption {
+	return func(c *Client) {
+		c.maxSamples = n
+	}
+}
+
+// WithMetadataCache shares cache between clients for catalog lookups.
+func WithMetadataCache(cache *MetadataCache) ClientOption {
+	return func(c *Client) {
+		c.metadataCache = cache
+	}
+}
+
+// WithResultsCache shares cache between clients for the results of completed time buckets.
+func WithResultsCache(cache *ResultsCache) ClientOption {
+	return func(c *Client) {
+		c.resultsCache = cache
+	}
+}
+
+// WithHTTPClients sets the clients sending requests to the management port (rest) and to HEC (hec),
+// e.g. created with NewHTTPClient for custom TLS settings. A nil hec uses rest for HEC too.
+func WithHTTPClients(rest, hec HTTPClient) ClientOption {
+	return func(c *Client) {
+		c.client = rest
+		c.hecClient = hec
+	}
 }
 
 func NewClient(
 	url, user, password,
 	index, sourcetype string,
 	hecUrl, hecToken string,
-	timeout time.Duration, log log.Logger) (RemoteClient, error) {
-	transCfg := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // ignore expired SSL certificates
-	}
-	return &Client{
+	timeout time.Duration, log log.Logger, opts ...ClientOption) (RemoteClient, error) {
+	c := &Client{
 		url:        url,
 		user:       user,
 		password:   password,
-		client:     &http.Client{Transport: transCfg},
+		client:     http.DefaultClient,
 		timeout:    timeout,
 		index:      index,
 		hecUrl:     hecUrl,
 		hecToken:   hecToken,
 		sourcetype: sourcetype,
 		log:        log,
-	}, nil
+		retry:      DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.wal != nil {
+		c.wal.start(c.writeEvents)
+	}
+	return c, nil
 }
 
+const searchJobsPath = "/services/search/jobs"
+
+// resultsPageSize is the number of results fetched in one request, it is the default
+// maxresultrows of splunk which caps larger counts.
+const resultsPageSize = 50000
+
 type jobResultPreview struct {
 	Fields []string   `json:"fields"`
 	Rows   [][]string `json:"rows"`
 }
 
+// appendRows appends the rows of page, whose fields may be ordered differently or be a subset of r.Fields.
+func (r *jobResultPreview) appendRows(page *jobResultPreview) {
+	index := make([]int, len(page.Fields))
+	for i, f := range page.Fields {
+		index[i] = -1
+		for j, rf := range r.Fields {
+			if rf == f {
+				index[i] = j
+				break
+			}
+		}
+		if index[i] < 0 {
+			index[i] = len(r.Fields)
+			r.Fields = append(r.Fields, f)
+		}
+	}
+	for _, values := range page.Rows {
+		row := make([]string, len(r.Fields))
+		for i, v := range values {
+			if i < len(index) {
+				row[index[i]] = v
+			}
+		}
+		r.Rows = append(r.Rows, row)
+	}
+}
+
 func (c *Client) Write(req *prompb.WriteRequest) error {
 	events := make([]SplunkMetricEvent, 0)
-	for _, series := range req.Timeseries {
-		es := TimeSeriesToPromMetrics(series)
-		events = append(events, es...)
-		// todo slice events
+	switch c.hecFormat {
+	case HECFormatMultiMetric:
+		events = TimeSeriesToMultiMetricEvents(req.Timeseries)
+	case HECFormatMetric:
+		for _, series := range req.Timeseries {
+			events = append(events, TimeSeriesToMetricEvents(series)...)
+		}
+	default:
+		for _, series := range req.Timeseries {
+			events = append(events, TimeSeriesToPromMetrics(series)...)
+		}
 	}
-	err := c.splunkHECEvents(events)
-	if err != nil {
-		metrics.SplunkEventsWroteFailed.Add(float64(len(events)))
-		return err
+	if c.wal != nil {
+		return c.wal.Append(events)
 	}
-	metrics.SplunkEventsWrote.Add(float64(len(events)))
-	return nil
+	return c.writeEvents(context.Background(), events)
 }
 
-func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
-	queryResults := make([]*prompb.QueryResult, 0)
-	for _, q := range req.Queries {
-		search, err := MakeSPL(q, c, c.index)
+// writeEvents sends events to HEC in batches, batches are not retried once ctx is done.
+func (c *Client) writeEvents(ctx context.Context, events []SplunkMetricEvent) error {
+	var lastErr error
+	for _, batch := range c.sliceEvents(events) {
+		err := c.splunkHECEvents(ctx, batch.body.Bytes())
 		if err != nil {
-			level.Error(c.log).Log("msg", err)
-			return nil, err
-		}
-		level.Debug(c.log).Log("rendered_search", search, "earliest", q.StartTimestampMs, "latest", q.EndTimestampMs)
-		timeStarted := time.Now()
-		res, err := c.runSearchWithResult(search, q.StartTimestampMs, q.EndTimestampMs)
-		if err != nil {
-			level.Error(c.log).Log("msg", err)
-			return nil, err
-		}
-		metrics.SplunkJobLatency.Observe(float64(time.Now().Sub(timeStarted) / time.Second))
-		var resPreview jobResultPreview
-		json.Unmarshal(res, &resPreview)
-		if len(resPreview.Fields) == 0 {
-			break
-		}
-		keysMap := make(map[string]*prompb.TimeSeries)
-
-		for _, values := range resPreview.Rows {
-			var labelValueList []string
-			key := ""
-			l := make([]prompb.Label, 0)
-			var t time.Time
-			var value float64
-			for i, v := range values {
-				k := resPreview.Fields[i]
-				if k == CommonMetricName {
-					k = "__name__"
-				}
-				if k == "_time" {
-					t, _ = time.Parse(time.RFC3339, v)
-					continue
-				}
-				if k == CommonMetricValue {
-					value, _ = strconv.ParseFloat(v, 64)
-					continue
-				}
-				l = append(l, prompb.Label{
-					Name:  k,
-					Value: v,
-				})
-				labelValueList = append(labelValueList, v)
-			}
-			key = strings.Join(labelValueList, ",")
-			if _, ok := keysMap[key]; !ok {
-				tv := make([]prompb.Sample, 0)
-				tv = append(tv, prompb.Sample{Timestamp: t.Unix() * 1000, Value: value})
-				keysMap[key] = &prompb.TimeSeries{
-					Labels:  l,
-					Samples: tv,
-				}
-			} else {
-				s := keysMap[key]
-				s.Samples = append(keysMap[key].Samples, prompb.Sample{Timestamp: t.Unix() * 1000, Value: value})
-				keysMap[key] = s
+			level.Error(c.log).Log("type", "hec-events", "events", batch.events, "err", err)
+			metrics.SplunkEventsWroteFailed.Add(float64(batch.events))
+			// a recoverable error wins, so that prometheus retries the request.
+			if lastErr == nil || !IsRecoverable(lastErr) {
+				lastErr = err
 			}
+			continue
+		}
+		metrics.SplunkEventsWrote.Add(float64(batch.events))
+	}
+	return lastErr
+}
+
+type hecBatch struct {
+	events int
+	body   bytes.Buffer
+}
+
+// sliceEvents encodes events to HEC json and splits them into batches
+// limited by batchMaxEvents and batchMaxBytes.
+func (c *Client) sliceEvents(events []SplunkMetricEvent) []*hecBatch {
+	batches := make([]*hecBatch, 0)
+	var current *hecBatch
+	for _, event := range events {
+		e := c.encodeHECEvent(event)
+		if current != nil && (c.batchMaxEvents > 0 && current.events >= c.batchMaxEvents ||
+			c.batchMaxBytes > 0 && current.body.Len()+len(e) > c.batchMaxBytes) {
+			current = nil
 		}
-		timeSeries := make([]*prompb.TimeSeries, 0)
-		for _, value := range keysMap {
-			timeSeries = append(timeSeries, value)
+		if current == nil {
+			current = &hecBatch{}
+			batches = append(batches, current)
 		}
-		queryResults = append(queryResults, &prompb.QueryResult{
-			Timeseries: timeSeries,
+		current.body.Write(e)
+		current.events++
+	}
+	return batches
+}
+
+func (c *Client) encodeHECEvent(event SplunkMetricEvent) []byte {
+	if event.Fields != nil {
+		e, _ := json.Marshal(map[string]interface{}{
+			"index":      c.index,
+			"sourcetype": c.sourcetype,
+			"time":       strconv.FormatFloat(float64(event.Time)/1000.0, 'f', -1, 64),
+			"event":      "metric",
+			"source":     "ropee-client/1.0",
+			"fields":     event.Fields,
 		})
+		return e
+	}
+	e, _ := json.Marshal(map[string]string{
+		"index":      c.index,
+		"sourcetype": c.sourcetype,
+		"time":       strconv.FormatFloat(float64(event.Time)/1000.0, 'f', -1, 64),
+		"event":      event.MetricStr,
+		"source":     "ropee-client/1.0",
+	})
+	return e
+}
+
+func (c *Client) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	queryResults := make([]*prompb.QueryResult, len(req.Queries))
+	err := c.runQueries(ctx, req.Queries, func(i int, res *prompb.QueryResult) error {
+		queryResults[i] = res
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return &prompb.ReadResponse{
 		Results: queryResults,
 	}, nil
 }
 
+// runQueries searches queries in parallel and calls handle with the index and the result of every query,
+// handle may be called concurrently. The first error cancels the remaining searches and is returned.
+func (c *Client) runQueries(ctx context.Context, queries []*prompb.Query, handle func(int, *prompb.QueryResult) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		errOnce  sync.Once
+		firstErr error
+	)
+	concurrency := c.queryConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	// no query is started once ctx is done, either by the caller or by the first error.
+dispatch:
+	for i, q := range queries {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		if err := c.queryLimiter.acquire(ctx); err != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int, q *prompb.Query) {
+			defer func() {
+				c.queryLimiter.release()
+				<-sem
+				wg.Done()
+			}()
+			res, err := c.readQuery(ctx, q)
+			if err == nil {
+				err = handle(i, res)
+			}
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i, q)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		// cancelled by the caller before all queries ran.
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+func (c *Client) readQuery(ctx context.Context, q *prompb.Query) (*prompb.QueryResult, error) {
+	search, err := MakeSPL(ctx, q, c, c.index, c.readOpts)
+	if ctx.Err() != nil {
+		// the catalog lookups of a cancelled query are incomplete.
+		return nil, ctx.Err()
+	}
+	if err == ErrNoMatchedMetrics {
+		return &prompb.QueryResult{}, nil
+	}
+	if err != nil {
+		level.Error(c.log).Log("msg", err)
+		return nil, err
+	}
+	level.Debug(c.log).Log("rendered_search", search, "earliest", q.StartTimestampMs, "latest", q.EndTimestampMs)
+	res, err := c.cachedSearch(ctx, q, search)
+	if err != nil {
+		level.Error(c.log).Log("msg", err)
+		return nil, err
+	}
+	return &prompb.QueryResult{
+		Timeseries: rowsToTimeSeries(res.Fields, res.Rows),
+	}, nil
+}
+
+// search runs search over [start, end) with the search mode of the client.
+func (c *Client) search(ctx context.Context, search string, start, end int64) (*jobResultPreview, error) {
+	timeStarted := time.Now()
+	var res *jobResultPreview
+	var err error
+	switch c.searchMode {
+	case SearchModeOneshot:
+		res, err = c.runOneshotSearch(ctx, search, start, end)
+	case SearchModeExport:
+		res, err = c.runExportSearch(ctx, search, start, end)
+	default:
+		res, err = c.runJobSearch(ctx, search, start, end)
+	}
+	if err != nil {
+		return nil, err
+	}
+	metrics.SplunkJobLatency.Observe(time.Since(timeStarted).Seconds())
+	return res, nil
+}
+
+func (c *Client) hecHTTPClient() HTTPClient {
+	if c.hecClient != nil {
+		return c.hecClient
+	}
+	return c.client
+}
+
 func urlJoin(baseUrl, reqPath string) (string, error) {
 	u, err := url.Parse(baseUrl)
 	if err != nil {
@@ -171,85 +455,116 @@ func urlJoin(baseUrl, reqPath string) (string, error) {
 	return u.String(), nil
 }
 
-func (c *Client) splunkHECEvents(events []SplunkMetricEvent) error {
-	var buffer bytes.Buffer
+func (c *Client) splunkHECEvents(ctx context.Context, body []byte) error {
 	var reqUrl string
 	if _url, err := urlJoin(c.hecUrl, "/services/collector"); err == nil {
 		reqUrl = _url
 	} else {
 		return err
 	}
-	for _, event := range events {
-		e, _ := json.Marshal(map[string]string{
-			"index":      c.index,
-			"sourcetype": c.sourcetype,
-			"time":       strconv.FormatFloat(float64(event.Time)/1000.0, 'f', -1, 64),
-			"event":      event.MetricStr,
-			"source":     "ropee-client/1.0",
-		})
-		buffer.Write(e)
-	}
-	httpReq, err := http.NewRequest("POST", reqUrl, strings.NewReader(buffer.String()))
-	if err != nil {
-		level.Error(c.log).Log("type", "hec-events", "err", err)
-	}
-	httpReq.Header.Set("User-Agent", "ropee client/1.0")
-	httpReq.SetBasicAuth("x", c.hecToken)
-
-	ctx := context.Background()
-
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 
-	httpResp, err := c.client.Do(httpReq.WithContext(ctx))
+	httpResp, err := c.doWithRetry(ctx, c.hecHTTPClient(), "hec", true, func() (*http.Request, error) {
+		httpReq, err := http.NewRequest("POST", reqUrl, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("User-Agent", "ropee client/1.0")
+		httpReq.SetBasicAuth("x", c.hecToken)
+		return httpReq, nil
+	})
 	if err != nil {
 		return err
 	}
+	defer httpResp.Body.Close()
 	if httpResp.StatusCode >= 400 {
-		level.Warn(c.log).Log("type", "hec-events-resp", "status", httpResp.StatusCode)
+		respBody, _ := ioutil.ReadAll(httpResp.Body)
+		hecErr := newHECError(httpResp.StatusCode, respBody)
+		level.Warn(c.log).Log("type", "hec-events-resp", "status", httpResp.StatusCode, "code", hecErr.Code, "text", hecErr.Text)
+		return hecErr
 	}
 	return nil
 }
 
-func (c *Client) splunkRESTRequest(method, reqPath string, params, body map[string]string) ([]byte, error) {
-	var b io.Reader = nil
+func (c *Client) splunkRESTRequest(ctx context.Context, method, reqPath string, params, body map[string]string) ([]byte, error) {
+	var res []byte
+	err := c.splunkRESTStream(ctx, method, reqPath, params, body, func(r io.Reader) error {
+		var err error
+		res, err = ioutil.ReadAll(r)
+		return err
+	})
+	return res, err
+}
+
+// splunkRESTStream sends a REST request and calls read with the response body as it arrives,
+// the timeout of the client also covers read.
+func (c *Client) splunkRESTStream(ctx context.Context, method, reqPath string, params, body map[string]string, read func(io.Reader) error) error {
+	var encodedBody string
 	if body != nil {
 		p := url.Values{}
 		for k, v := range body {
 			p.Add(k, v)
 		}
-		b = strings.NewReader(p.Encode())
+		encodedBody = p.Encode()
 	}
 	var reqUrl string
 	if _url, err := urlJoin(c.url, reqPath); err == nil {
 		reqUrl = _url
 	} else {
-		return nil, err
-	}
-	httpReq, err := http.NewRequest(method, reqUrl, b)
-	httpReq.SetBasicAuth(c.user, c.password)
-	q := httpReq.URL.Query()
-	if _, ok := params["output_mode"]; !ok {
-		q.Add("output_mode", "json")
-	}
-	q.Add("count", "50000")
-	for k, v := range params {
-		q.Add(k, v)
+		return err
 	}
-	httpReq.URL.RawQuery = q.Encode()
-	httpReq.Header.Set("User-Agent", "ropee client/1.0")
-
-	ctx := context.Background()
 
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 
-	httpResp, err := c.client.Do(httpReq.WithContext(ctx))
+	// a job created by a request whose response is lost would never be cancelled.
+	createsJob := method == "POST" && reqPath == searchJobsPath
+	httpResp, err := c.doWithRetry(ctx, c.client, "rest", !createsJob, func() (*http.Request, error) {
+		var b io.Reader = nil
+		if body != nil {
+			b = strings.NewReader(encodedBody)
+		}
+		httpReq, err := http.NewRequest(method, reqUrl, b)
+		if err != nil {
+			return nil, err
+		}
+		httpReq.SetBasicAuth(c.user, c.password)
+		q := httpReq.URL.Query()
+		if _, ok := params["output_mode"]; !ok {
+			q.Add("output_mode", "json")
+		}
+		// listings like the catalog return 30 entries by default.
+		if _, ok := params["count"]; !ok && method == "GET" {
+			q.Add("count", strconv.Itoa(resultsPageSize))
+		}
+		for k, v := range params {
+			q.Add(k, v)
+		}
+		httpReq.URL.RawQuery = q.Encode()
+		httpReq.Header.Set("User-Agent", "ropee client/1.0")
+		return httpReq, nil
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer httpResp.Body.Close()
-	return ioutil.ReadAll(httpResp.Body)
+	// error pages like an unknown sid or expired credentials would decode as empty results.
+	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
+		return restStatusError(method, reqPath, httpResp)
+	}
+	return read(httpResp.Body)
+}
+
+// restStatusError returns the messages of a splunk error response, or its status if it has none.
+func restStatusError(method, reqPath string, resp *http.Response) error {
+	prefix := fmt.Sprintf("%s %s: status %d", method, reqPath, resp.StatusCode)
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var status jobStatus
+	if json.Unmarshal(b, &status) == nil && len(status.Messages) > 0 {
+		return jobMessagesError(prefix, status.Messages)
+	}
+	return errors.New(prefix)
 }
 
 type Metric struct {
@@ -264,93 +579,305 @@ type LabelValue struct {
 	Name string `json:"name"`
 }
 
-func (c *Client) GetMetrics() []string {
+func (c *Client) GetMetrics(ctx context.Context) []string {
 	var params = map[string]string{
 		"filter": "index=" + c.index,
 	}
-
-	res, _ := c.splunkRESTRequest("GET", "/services/catalog/metricstore/metrics", params, nil)
-	var result map[string][]Metric
-	json.Unmarshal(res, &result)
-	ls := make([]string, 0)
-	for l := 0; l < len(result["entry"]); l++ {
-		ls = append(ls, result["entry"][l].Name)
-	}
-	return ls
+	return c.catalogNames(ctx, "metrics", "/services/catalog/metricstore/metrics", params)
 }
 
-func (c *Client) MetricLabels(metricName string) []string {
+func (c *Client) MetricLabels(ctx context.Context, metricName string) []string {
 	var params = map[string]string{
 		"filter":      "index=" + c.index,
 		"metric_name": metricName,
 	}
-
-	res, _ := c.splunkRESTRequest("GET", "/services/catalog/metricstore/dimensions", params, nil)
-	var result map[string][]MetricLabel
-	json.Unmarshal(res, &result)
 	ls := make([]string, 0)
-	for l := 0; l < len(result["entry"]); l++ {
-		if result["entry"][l].Name == "source" || result["entry"][l].Name == "sourcetype" {
+	for _, name := range c.catalogNames(ctx, "dimensions", "/services/catalog/metricstore/dimensions", params) {
+		if name == "source" || name == "sourcetype" {
 			continue
 		}
-		ls = append(ls, result["entry"][l].Name)
+		ls = append(ls, name)
 	}
 	return ls
 }
 
-func (c *Client) LabelValues(labelName string) []string {
+func (c *Client) LabelValues(ctx context.Context, labelName string) []string {
 	if labelName == "__name__" {
-		return c.GetMetrics()
+		return c.GetMetrics(ctx)
 	}
 	var params = map[string]string{
 		"filter":      "index=" + c.index,
 		"metric_name": "*",
 	}
+	return c.catalogNames(ctx, "values", "/services/catalog/metricstore/dimensions/"+labelName+"/values", params)
+}
 
-	res, _ := c.splunkRESTRequest("GET",
-		"/services/catalog/metricstore/dimensions/"+labelName+"/values", params, nil)
-	var result map[string][]LabelValue
+// catalogNames returns the entry names of a catalog endpoint. Results are cached per user
+// as splunk may show them different catalogs, failed lookups are not cached.
+func (c *Client) catalogNames(ctx context.Context, kind, reqPath string, params map[string]string) []string {
+	q := url.Values{}
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	key := c.user + "\xff" + reqPath + "?" + q.Encode()
+	if names, ok := c.metadataCache.get(kind, key); ok {
+		return names
+	}
+	res, err := c.splunkRESTRequest(ctx, "GET", reqPath, params, nil)
+	if err != nil {
+		return []string{}
+	}
+	var result map[string][]Metric
 	json.Unmarshal(res, &result)
-	ls := make([]string, 0)
-	for l := 0; l < len(result["entry"]); l++ {
-		ls = append(ls, result["entry"][l].Name)
+	entries, ok := result["entry"]
+	ls := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ls = append(ls, e.Name)
+	}
+	if ok {
+		c.metadataCache.set(key, ls)
 	}
 	return ls
 }
 
-func (c *Client) runSearchWithResult(search string, start, end int64) ([]byte, error) {
-	body := map[string]string{
+// searchParams searches the milliseconds from start to end, both included. Splunk takes epoch seconds
+// with a fraction and excludes latest_time, so it is set to the millisecond after end.
+func searchParams(search string, start, end int64) map[string]string {
+	return map[string]string{
 		"search":        search,
-		"latest_time":   strconv.FormatInt(int64(end)/1000, 10),
-		"earliest_time": strconv.FormatInt(int64(start)/1000, 10),
+		"latest_time":   epochSeconds(end + 1),
+		"earliest_time": epochSeconds(start),
+	}
+}
+
+func epochSeconds(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', 3, 64)
+}
+
+type jobMessage struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type jobStatus struct {
+	Sid      string       `json:"sid"`
+	Messages []jobMessage `json:"messages"`
+	Entry    []struct {
+		Content struct {
+			DispatchState string       `json:"dispatchState"`
+			IsDone        bool         `json:"isDone"`
+			IsFailed      bool         `json:"isFailed"`
+			ResultCount   int          `json:"resultCount"`
+			Messages      []jobMessage `json:"messages"`
+		} `json:"content"`
+	} `json:"entry"`
+}
+
+// searchErrors returns the messages of a search response which report a failed search.
+func searchErrors(messages []jobMessage) []jobMessage {
+	errs := make([]jobMessage, 0)
+	for _, m := range messages {
+		if m.Type == "FATAL" || m.Type == "ERROR" {
+			errs = append(errs, m)
+		}
+	}
+	return errs
+}
+
+func jobMessagesError(prefix string, messages []jobMessage) error {
+	texts := make([]string, 0, len(messages))
+	for _, m := range messages {
+		texts = append(texts, m.Type+": "+m.Text)
+	}
+	return fmt.Errorf("%s: %s", prefix, strings.Join(texts, "; "))
+}
+
+// runJobSearch creates a search job, polls it until it is done and fetches its results.
+// The job is cancelled when ctx is done or the search fails, finished jobs expire after jobTTL.
+func (c *Client) runJobSearch(ctx context.Context, search string, start, end int64) (*jobResultPreview, error) {
+	body := searchParams(search, start, end)
+	if c.jobTTL > 0 {
+		body["timeout"] = strconv.FormatInt(int64(c.jobTTL/time.Second), 10)
 	}
-	var result map[string]string
-	res, err := c.splunkRESTRequest("POST", "/services/search/jobs", nil, body)
+	var created jobStatus
+	res, err := c.splunkRESTRequest(ctx, "POST", searchJobsPath, nil, body)
 	if err != nil {
 		return nil, err
 	}
-	json.Unmarshal(res, &result)
-	sid := result["sid"]
+	json.Unmarshal(res, &created)
+	sid := created.Sid
+	if sid == "" {
+		return nil, jobMessagesError("create job error", created.Messages)
+	}
+	done := false
+	defer func() {
+		if !done {
+			c.cancelJob(sid)
+		}
+	}()
 	for {
-		time.Sleep(100 * time.Millisecond)
-		var jobResult map[string][]map[string]map[string]bool
-		res, _ := c.splunkRESTRequest("GET", "/services/search/jobs/"+sid, nil, body)
-
-		json.Unmarshal(res, &jobResult)
-		jobs := jobResult["entry"]
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+		var status jobStatus
+		res, err := c.splunkRESTRequest(ctx, "GET", "/services/search/jobs/"+sid, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(res, &status)
+		jobs := status.Entry
 		if len(jobs) < 1 {
 			return nil, fmt.Errorf("get job error")
 		}
-		if jobs[0]["content"]["isDone"] {
+		content := jobs[0].Content
+		if content.IsFailed || content.DispatchState == "FAILED" {
+			return nil, jobMessagesError("search job "+sid+" failed", content.Messages)
+		}
+		if content.IsDone {
+			if err := c.checkSamples(content.ResultCount); err != nil {
+				return nil, err
+			}
 			break
 		}
 	}
-	return c.splunkRESTRequest(
-		"GET",
-		"/servicesNS/nobody/-/search/jobs/"+sid+"/results_preview",
-		map[string]string{
-			"output_mode": "json_rows",
-		},
-		nil,
-	)
+	resPreview := &jobResultPreview{}
+	for offset := 0; ; offset += resultsPageSize {
+		res, err := c.splunkRESTRequest(
+			ctx,
+			"GET",
+			"/servicesNS/nobody/-/search/jobs/"+sid+"/results",
+			map[string]string{
+				"output_mode": "json_rows",
+				"offset":      strconv.Itoa(offset),
+				"count":       strconv.Itoa(resultsPageSize),
+			},
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		var page jobResultPreview
+		if len(res) > 0 {
+			if err := json.Unmarshal(res, &page); err != nil {
+				return nil, fmt.Errorf("invalid search results: %s", err)
+			}
+		}
+		resPreview.appendRows(&page)
+		if err := c.checkSamples(len(resPreview.Rows)); err != nil {
+			return nil, err
+		}
+		if len(page.Rows) < resultsPageSize {
+			break
+		}
+	}
+	done = true
+	return resPreview, nil
+}
+
+// checkSamples returns a TooManySamplesError when n exceeds the max samples of a query.
+func (c *Client) checkSamples(n int) error {
+	if c.maxSamples > 0 && n > c.maxSamples {
+		return &TooManySamplesError{Limit: c.maxSamples}
+	}
+	return nil
+}
+
+// cancelJob stops a job and removes its artifacts from the search head.
+func (c *Client) cancelJob(sid string) {
+	_, err := c.splunkRESTRequest(context.Background(), "POST", "/services/search/jobs/"+sid+"/control", nil, map[string]string{
+		"action": "cancel",
+	})
+	if err != nil {
+		level.Warn(c.log).Log("msg", "cancel job error", "sid", sid, "err", err)
+		return
+	}
+	metrics.SplunkJobsCancelled.Inc()
+	level.Debug(c.log).Log("msg", "job cancelled", "sid", sid)
+}
+
+// runOneshotSearch runs the search in a single blocking request, no job is left on the search head.
+// Oneshot results can not be paged, searches returning a full page are rejected instead of truncated.
+func (c *Client) runOneshotSearch(ctx context.Context, search string, start, end int64) (*jobResultPreview, error) {
+	body := searchParams(search, start, end)
+	body["exec_mode"] = "oneshot"
+	count := resultsPageSize
+	if c.maxSamples > 0 && c.maxSamples < count {
+		count = c.maxSamples + 1
+	}
+	res, err := c.splunkRESTRequest(ctx, "POST", searchJobsPath, map[string]string{
+		"output_mode": "json_rows",
+		"count":       strconv.Itoa(count),
+	}, body)
+	if err != nil {
+		return nil, err
+	}
+	var oneshot struct {
+		jobResultPreview
+		Messages []jobMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(res, &oneshot); err != nil {
+		return nil, fmt.Errorf("invalid oneshot search result: %s", err)
+	}
+	if errs := searchErrors(oneshot.Messages); len(errs) > 0 {
+		return nil, jobMessagesError("oneshot search failed", errs)
+	}
+	resPreview := oneshot.jobResultPreview
+	if err := c.checkSamples(len(resPreview.Rows)); err != nil {
+		return nil, err
+	}
+	if len(resPreview.Rows) >= resultsPageSize {
+		return nil, fmt.Errorf("oneshot search results exceed %d rows, use the job or export search mode", resultsPageSize)
+	}
+	return &resPreview, nil
+}
+
+type exportResult struct {
+	Preview  bool              `json:"preview"`
+	Result   map[string]string `json:"result"`
+	Messages []jobMessage      `json:"messages"`
+}
+
+// runExportSearch streams the results of the search from the export endpoint,
+// which returns one json object per result line. Results are decoded as they arrive,
+// the search is aborted as soon as it exceeds the max samples.
+func (c *Client) runExportSearch(ctx context.Context, search string, start, end int64) (*jobResultPreview, error) {
+	resPreview := &jobResultPreview{}
+	fieldIndex := make(map[string]int)
+	err := c.splunkRESTStream(ctx, "POST", "/services/search/jobs/export", nil, searchParams(search, start, end), func(r io.Reader) error {
+		decoder := json.NewDecoder(r)
+		for {
+			var line exportResult
+			if err := decoder.Decode(&line); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("invalid export search result: %s", err)
+			}
+			if errs := searchErrors(line.Messages); len(errs) > 0 {
+				return jobMessagesError("export search failed", errs)
+			}
+			if line.Preview || line.Result == nil {
+				continue
+			}
+			for k := range line.Result {
+				if _, ok := fieldIndex[k]; !ok {
+					fieldIndex[k] = len(resPreview.Fields)
+					resPreview.Fields = append(resPreview.Fields, k)
+				}
+			}
+			row := make([]string, len(resPreview.Fields))
+			for k, v := range line.Result {
+				row[fieldIndex[k]] = v
+			}
+			resPreview.Rows = append(resPreview.Rows, row)
+			if err := c.checkSamples(len(resPreview.Rows)); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resPreview, nil
 }
@@ -1,38 +1,261 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kebe7jun/ropee/test"
 	"github.com/prometheus/prometheus/prompb"
 )
 
-type fakeClient struct {
-	expectBody string
-	status     int
-	body       string
+// route answers the requests with method (any if empty) whose path ends with suffix,
+// a "*" segment of suffix matches any path segment.
+type route struct {
+	method string
+	suffix string
+	handle func(req *http.Request) (int, string)
 }
 
-func (f *fakeClient) Do(req *http.Request) (*http.Response, error) {
+func reply(status int, body string) func(*http.Request) (int, string) {
+	return func(*http.Request) (int, string) {
+		return status, body
+	}
+}
+
+// routeClient answers a request with the first matching route, other requests get an empty
+// catalog response or fail with unrouted if set. It records all requests as "METHOD path"
+// and their bodies.
+type routeClient struct {
+	routes   []route
+	unrouted error
+
+	mtx      sync.Mutex
+	requests []string
+	bodies   []string
+}
+
+func (f *routeClient) Do(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
 	if req.Body != nil {
-		bs, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			return nil, err
-		}
-		if f.expectBody != "" && string(bs) != f.expectBody {
-			return nil, fmt.Errorf("req expect error, body: %s, want: %s", bs, f.expectBody)
+		reqBody, _ = ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+	f.mtx.Lock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path)
+	f.bodies = append(f.bodies, string(reqBody))
+	f.mtx.Unlock()
+	status, body := 200, `{"entry":[]}`
+	routed := false
+	for _, r := range f.routes {
+		if (r.method == "" || r.method == req.Method) && matchPathSuffix(req.URL.Path, r.suffix) {
+			status, body = r.handle(req)
+			routed = true
+			break
 		}
 	}
+	if !routed && f.unrouted != nil {
+		return nil, f.unrouted
+	}
 	return &http.Response{
-		StatusCode: f.status,
-		Body:       test.NewBody(f.body),
+		StatusCode: status,
+		Body:       test.NewBody(body),
 	}, nil
 }
 
+func (f *routeClient) count() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.requests)
+}
+
+func matchPathSuffix(p, suffix string) bool {
+	ps := strings.Split(p, "/")
+	ss := strings.Split(strings.TrimPrefix(suffix, "/"), "/")
+	if len(ss) > len(ps) {
+		return false
+	}
+	ps = ps[len(ps)-len(ss):]
+	for i := range ss {
+		if ss[i] != "*" && ss[i] != ps[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// requestForm returns the url encoded form of a request body.
+func requestForm(req *http.Request) url.Values {
+	bs, _ := ioutil.ReadAll(req.Body)
+	form, _ := url.ParseQuery(string(bs))
+	return form
+}
+
+// replySeq answers the nth request with statuses[n] and body.
+func replySeq(statuses []int, body string) func(*http.Request) (int, string) {
+	var mtx sync.Mutex
+	n := 0
+	return func(*http.Request) (int, string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		n++
+		return statuses[n-1], body
+	}
+}
+
+var searchFields = []string{"ropee_metric_name", "_time", "ropee_metric_value"}
+
+// fakeSplunk answers the search endpoints of the job, oneshot and export search modes. Every search
+// returns the rows of its form, in fields (searchFields if nil) with empty values left out of exports,
+// exports start with a preview of the first row. Jobs and oneshot searches are recorded in searches,
+// jobs are named by their index in it from 1.
+type fakeSplunk struct {
+	fields []string
+	rows   func(form url.Values) [][]string
+	// status replaces the job status, which is done by default.
+	status string
+	// failOffset (if > 0) is the offset of a results page which is not found.
+	failOffset int
+	// delay slows down the job creations.
+	delay time.Duration
+
+	mtx        sync.Mutex
+	searches   []url.Values
+	cancelled  []string
+	offsets    []string
+	running    int
+	maxRunning int
+}
+
+func (s *fakeSplunk) client() *routeClient {
+	if s.fields == nil {
+		s.fields = searchFields
+	}
+	return &routeClient{routes: []route{
+		{"POST", "/search/jobs/export", s.export},
+		{"POST", "/search/jobs/*/control", func(req *http.Request) (int, string) {
+			s.mtx.Lock()
+			if requestForm(req).Get("action") == "cancel" {
+				s.cancelled = append(s.cancelled, path.Base(path.Dir(req.URL.Path)))
+			}
+			s.mtx.Unlock()
+			return 200, `{}`
+		}},
+		{"POST", "/search/jobs", s.create},
+		{"GET", "/search/jobs/*/results", s.results},
+		{"GET", "/search/jobs/*", func(req *http.Request) (int, string) {
+			if s.status != "" {
+				return 200, s.status
+			}
+			rows := s.rows(s.search(path.Base(req.URL.Path)))
+			return 200, fmt.Sprintf(`{"entry":[{"content":{"isDone":true,"resultCount":%d}}]}`, len(rows))
+		}},
+	}}
+}
+
+func (s *fakeSplunk) search(sid string) url.Values {
+	n, _ := strconv.Atoi(sid)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.searches[n-1]
+}
+
+func (s *fakeSplunk) create(req *http.Request) (int, string) {
+	form := requestForm(req)
+	s.mtx.Lock()
+	s.searches = append(s.searches, form)
+	sid := len(s.searches)
+	if form.Get("exec_mode") == "oneshot" {
+		s.mtx.Unlock()
+		return 200, s.jsonRows(s.rows(form))
+	}
+	s.running++
+	if s.running > s.maxRunning {
+		s.maxRunning = s.running
+	}
+	s.mtx.Unlock()
+	time.Sleep(s.delay)
+	return 200, fmt.Sprintf(`{"sid":"%d"}`, sid)
+}
+
+func (s *fakeSplunk) results(req *http.Request) (int, string) {
+	query := req.URL.Query()
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	count, _ := strconv.Atoi(query.Get("count"))
+	s.mtx.Lock()
+	s.offsets = append(s.offsets, query.Get("offset"))
+	if offset == 0 {
+		s.running--
+	}
+	s.mtx.Unlock()
+	if s.failOffset > 0 && offset == s.failOffset {
+		return 404, `{"messages":[{"type":"FATAL","text":"Unknown sid."}]}`
+	}
+	rows := s.rows(s.search(path.Base(path.Dir(req.URL.Path))))
+	if offset > len(rows) {
+		offset = len(rows)
+	}
+	if count > 0 && offset+count < len(rows) {
+		rows = rows[:offset+count]
+	}
+	return 200, s.jsonRows(rows[offset:])
+}
+
+func (s *fakeSplunk) jsonRows(rows [][]string) string {
+	bs, _ := json.Marshal(jobResultPreview{Fields: s.fields, Rows: rows})
+	return string(bs)
+}
+
+func (s *fakeSplunk) export(req *http.Request) (int, string) {
+	rows := s.rows(requestForm(req))
+	var b strings.Builder
+	line := func(preview bool, row []string) {
+		result := make(map[string]string)
+		for i, f := range s.fields {
+			if row[i] != "" {
+				result[f] = row[i]
+			}
+		}
+		if preview {
+			result["ropee_metric_value"] = "0"
+		}
+		bs, _ := json.Marshal(map[string]interface{}{"preview": preview, "result": result})
+		b.Write(append(bs, '\n'))
+	}
+	if len(rows) > 0 {
+		line(true, rows[0])
+	}
+	for _, row := range rows {
+		line(false, row)
+	}
+	return 200, b.String()
+}
+
+// sampleRows returns total samples of test at the seconds from 0.
+func sampleRows(total int) func(url.Values) [][]string {
+	return func(url.Values) [][]string {
+		rows := make([][]string, total)
+		for i := range rows {
+			rows[i] = []string{"test", strconv.Itoa(i), "1"}
+		}
+		return rows
+	}
+}
+
 func TestClient_Write(t *testing.T) {
 	cases := []struct {
 		name      string
@@ -98,40 +321,421 @@ func TestClient_Write(t *testing.T) {
 	}
 	for i, c := range cases {
 		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fc := &routeClient{}
 			client := Client{
-				url: "http://test.com",
-				client: &fakeClient{
-					expectBody: c.wannaBody,
-					status:     200,
+				url:    "http://test.com",
+				client: fc,
+			}
+			err := client.Write(&c.events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fc.bodies) != 1 || fc.bodies[0] != c.wannaBody {
+				t.Fatalf("unexpected body: %v, want: %s", fc.bodies, c.wannaBody)
+			}
+		})
+	}
+}
+
+func TestClient_WriteMetricFormat(t *testing.T) {
+	cases := []struct {
+		name      string
+		events    prompb.WriteRequest
+		wannaBody string
+	}{
+		{
+			"normal events",
+			prompb.WriteRequest{
+				Timeseries: []prompb.TimeSeries{
+					{
+						Labels: []prompb.Label{
+							{
+								Name:  "__name__",
+								Value: "test",
+							},
+							{
+								Name:  "test",
+								Value: "1",
+							},
+						},
+						Samples: []prompb.Sample{
+							{
+								Value:     1.5,
+								Timestamp: 1,
+							},
+						},
+					},
+				},
+			},
+			`{"event":"metric","fields":{"_value":1.5,"metric_name":"test","test":"1"},"index":"","source":"ropee-client/1.0","sourcetype":"","time":"0.001"}`,
+		},
+		{
+			"skip stale marker",
+			prompb.WriteRequest{
+				Timeseries: []prompb.TimeSeries{
+					{
+						Labels: []prompb.Label{
+							{
+								Name:  "__name__",
+								Value: "test",
+							},
+						},
+						Samples: []prompb.Sample{
+							{
+								Value:     math.NaN(),
+								Timestamp: 1,
+							},
+							{
+								Value:     2,
+								Timestamp: 2,
+							},
+						},
+					},
 				},
+			},
+			`{"event":"metric","fields":{"_value":2,"metric_name":"test"},"index":"","source":"ropee-client/1.0","sourcetype":"","time":"0.002"}`,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fc := &routeClient{}
+			client := Client{
+				url:       "http://test.com",
+				client:    fc,
+				hecFormat: HECFormatMetric,
 			}
 			err := client.Write(&c.events)
 			if err != nil {
 				t.Fatal(err)
 			}
+			if len(fc.bodies) != 1 || fc.bodies[0] != c.wannaBody {
+				t.Fatalf("unexpected body: %v, want: %s", fc.bodies, c.wannaBody)
+			}
 		})
 	}
 }
 
-type fakeReadClient struct {
-	status   int
-	bodyChan chan string
+func TestClient_WriteBatch(t *testing.T) {
+	req := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{
+					{
+						Name:  "__name__",
+						Value: "test",
+					},
+				},
+				Samples: []prompb.Sample{
+					{
+						Value:     1,
+						Timestamp: 1,
+					},
+					{
+						Value:     2,
+						Timestamp: 2,
+					},
+					{
+						Value:     3,
+						Timestamp: 3,
+					},
+				},
+			},
+		},
+	}
+	e1 := `{"event":"test{} 1","index":"","source":"ropee-client/1.0","sourcetype":"","time":"0.001"}`
+	e2 := `{"event":"test{} 2","index":"","source":"ropee-client/1.0","sourcetype":"","time":"0.002"}`
+	e3 := `{"event":"test{} 3","index":"","source":"ropee-client/1.0","sourcetype":"","time":"0.003"}`
+	cases := []struct {
+		name       string
+		maxEvents  int
+		maxBytes   int
+		wantBodies []string
+	}{
+		{
+			"no limit",
+			0,
+			0,
+			[]string{e1 + e2 + e3},
+		},
+		{
+			"max 2 events",
+			2,
+			0,
+			[]string{e1 + e2, e3},
+		},
+		{
+			"max bytes",
+			0,
+			len(e1) + 1,
+			[]string{e1, e2, e3},
+		},
+		{
+			"event larger than max bytes",
+			0,
+			1,
+			[]string{e1, e2, e3},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			rc := &routeClient{}
+			client := Client{
+				url:    "http://test.com",
+				client: rc,
+				log:    test.Logger(),
+			}
+			WithBatchSize(c.maxEvents, c.maxBytes)(&client)
+			if err := client.Write(&req); err != nil {
+				t.Fatal(err)
+			}
+			if len(rc.bodies) != len(c.wantBodies) {
+				t.Fatalf("unexpected bodies: %v, want: %v", rc.bodies, c.wantBodies)
+			}
+			for j, b := range rc.bodies {
+				if b != c.wantBodies[j] {
+					t.Fatalf("unexpected body %d: %s, want: %s", j, b, c.wantBodies[j])
+				}
+			}
+		})
+	}
 }
 
-func (f *fakeReadClient) Do(req *http.Request) (*http.Response, error) {
-	return &http.Response{
-		StatusCode: f.status,
-		Body:       test.NewBody(<-f.bodyChan),
-	}, nil
+func TestClient_WriteError(t *testing.T) {
+	req := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{
+					{
+						Name:  "__name__",
+						Value: "test",
+					},
+				},
+				Samples: []prompb.Sample{
+					{
+						Value:     1,
+						Timestamp: 1,
+					},
+				},
+			},
+		},
+	}
+	cases := []struct {
+		name             string
+		status           int
+		body             string
+		wannaErr         string
+		wannaRecoverable bool
+	}{
+		{
+			"success",
+			200,
+			`{"text":"Success","code":0}`,
+			"",
+			false,
+		},
+		{
+			"invalid data format",
+			400,
+			`{"text":"Invalid data format","code":6,"invalid-event-number":0}`,
+			"hec error, status: 400, code: 6, text: Invalid data format, invalid event number: 0",
+			false,
+		},
+		{
+			"server busy",
+			503,
+			`{"text":"Server is busy","code":9}`,
+			"hec error, status: 503, code: 9, text: Server is busy",
+			true,
+		},
+		{
+			"invalid token",
+			403,
+			`{"text":"Invalid token","code":4}`,
+			"hec error, status: 403, code: 4, text: Invalid token",
+			true,
+		},
+		{
+			"not json",
+			502,
+			`bad gateway`,
+			"hec error, status: 502, code: -1, text: bad gateway",
+			true,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			client := Client{
+				url: "http://test.com",
+				client: &routeClient{routes: []route{
+					{"POST", "/services/collector", reply(c.status, c.body)},
+				}},
+				log: test.Logger(),
+			}
+			err := client.Write(&req)
+			if c.wannaErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != c.wannaErr {
+				t.Fatalf("unexpected err: %v, want: %s", err, c.wannaErr)
+			}
+			if IsRecoverable(err) != c.wannaRecoverable {
+				t.Fatalf("unexpected recoverable: %v, want: %v", IsRecoverable(err), c.wannaRecoverable)
+			}
+		})
+	}
 }
 
-func TestClient_Read(t *testing.T) {
+func TestClient_WriteRetry(t *testing.T) {
+	req := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{
+					{
+						Name:  "__name__",
+						Value: "test",
+					},
+				},
+				Samples: []prompb.Sample{
+					{
+						Value:     1,
+						Timestamp: 1,
+					},
+				},
+			},
+		},
+	}
+	policy := RetryPolicy{
+		MaxAttempts:     3,
+		BaseBackoff:     time.Millisecond,
+		MaxBackoff:      time.Millisecond,
+		RetryableStatus: map[int]bool{503: true},
+	}
 	cases := []struct {
 		name      string
-		req       prompb.ReadRequest
-		splunkRes string
-		bodys     []string
-		wannaRes  string
+		statuses  []int
+		wannaErr  bool
+		wannaCall int
+	}{
+		{
+			"success after retry",
+			[]int{503, 503, 200},
+			false,
+			3,
+		},
+		{
+			"attempts exhausted",
+			[]int{503, 503, 503},
+			true,
+			3,
+		},
+		{
+			"not retryable",
+			[]int{400},
+			true,
+			1,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			sc := &routeClient{routes: []route{
+				{"POST", "/services/collector", replySeq(c.statuses, `{"text":"Server is busy","code":9}`)},
+			}}
+			client := Client{
+				url:     "http://test.com",
+				client:  sc,
+				timeout: time.Second,
+				retry:   policy,
+				log:     test.Logger(),
+			}
+			err := client.Write(&req)
+			if (err != nil) != c.wannaErr || sc.count() != c.wannaCall {
+				t.Fatalf("unexpected err: %v, calls: %d, want err: %v, calls: %d", err, sc.count(), c.wannaErr, c.wannaCall)
+			}
+		})
+	}
+}
+
+func TestClient_RetryTransportErrors(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		BaseBackoff: time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+	}
+	cases := []struct {
+		name       string
+		do         func(c *Client) error
+		wannaPosts int
+	}{
+		{
+			"hec write retried",
+			func(c *Client) error {
+				return c.Write(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+					{
+						Labels:  []prompb.Label{{Name: "__name__", Value: "test"}},
+						Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+					},
+				}})
+			},
+			3,
+		},
+		{
+			"job creation not retried",
+			func(c *Client) error {
+				_, err := c.Read(context.Background(), &prompb.ReadRequest{Queries: []*prompb.Query{
+					{
+						EndTimestampMs: 10,
+						Matchers:       []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test"}},
+						Hints:          &prompb.ReadHints{},
+					},
+				}})
+				return err
+			},
+			1,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fc := &routeClient{
+				routes: []route{
+					{"GET", "/dimensions", reply(200, `{"entry":[]}`)},
+				},
+				unrouted: fmt.Errorf("connection reset by peer"),
+			}
+			client := Client{
+				url:     "http://test.com",
+				hecUrl:  "http://test.com",
+				client:  fc,
+				index:   "test",
+				timeout: time.Second,
+				retry:   policy,
+				log:     test.Logger(),
+			}
+			if err := c.do(&client); err == nil {
+				t.Fatal("transport error not returned")
+			}
+			posts := 0
+			for _, r := range fc.requests {
+				if strings.HasPrefix(r, "POST ") {
+					posts++
+				}
+			}
+			if posts != c.wannaPosts {
+				t.Fatalf("unexpected posts: %d, want: %d, requests: %v", posts, c.wannaPosts, fc.requests)
+			}
+		})
+	}
+}
+
+func TestClient_Read(t *testing.T) {
+	cases := []struct {
+		name     string
+		req      prompb.ReadRequest
+		fields   []string
+		rows     [][]string
+		wannaRes string
 	}{
 		{
 			"normal read",
@@ -153,31 +757,26 @@ func TestClient_Read(t *testing.T) {
 					},
 				},
 			},
-			`{}`,
-			[]string{
-				"[]",
-				`{"sid":"1"}`,
-				`{"sid":"1","entry":[{"content":{"isDone":true}}]}`,
-				`{"fields":["ropee_metric_name","ropee_metric_value","_time"],"rows":[["test","test","1970-01-01T00:00:01Z"]]}`,
-			},
+			[]string{"ropee_metric_name", "ropee_metric_value", "_time"},
+			[][]string{{"test", "test", "1970-01-01T00:00:01Z"}},
 			`{"results":[{"timeseries":[{"labels":[{"name":"__name__","value":"test"}],"samples":[{"timestamp":1000}]}]}]}`,
 		},
 	}
 	for i, c := range cases {
 		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
-			bodyChan := make(chan string, len(c.bodys))
-			for _, s := range c.bodys {
-				bodyChan <- s
+			fs := &fakeSplunk{
+				fields: c.fields,
+				rows: func(url.Values) [][]string {
+					return c.rows
+				},
 			}
 			client := Client{
-				url: "http://test.com",
-				client: &fakeReadClient{
-					status:   200,
-					bodyChan: bodyChan,
-				},
-				log: test.Logger(),
+				url:    "http://test.com",
+				client: fs.client(),
+				index:  "test",
+				log:    test.Logger(),
 			}
-			res, err := client.Read(&c.req)
+			res, err := client.Read(context.Background(), &c.req)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -188,3 +787,557 @@ func TestClient_Read(t *testing.T) {
 		})
 	}
 }
+
+var searchMetricRe = regexp.MustCompile(`metric_name=(\w+)`)
+
+// metricRows returns one sample of the searched metric.
+func metricRows(form url.Values) [][]string {
+	return [][]string{{searchMetricRe.FindStringSubmatch(form.Get("search"))[1], "1", "1"}}
+}
+
+func TestClient_ReadConcurrency(t *testing.T) {
+	req := prompb.ReadRequest{}
+	for i := 0; i < 6; i++ {
+		req.Queries = append(req.Queries, &prompb.Query{
+			StartTimestampMs: 0,
+			EndTimestampMs:   10,
+			Matchers: []*prompb.LabelMatcher{
+				{
+					Type:  prompb.LabelMatcher_EQ,
+					Name:  "__name__",
+					Value: fmt.Sprintf("test%d", i),
+				},
+			},
+			Hints: &prompb.ReadHints{},
+		})
+	}
+	cases := []struct {
+		name       string
+		perRequest int
+		global     int
+		wannaMax   int
+	}{
+		{
+			"sequential",
+			1,
+			0,
+			1,
+		},
+		{
+			"per request limit",
+			3,
+			0,
+			3,
+		},
+		{
+			"global limit",
+			6,
+			2,
+			2,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fs := &fakeSplunk{rows: metricRows, delay: 10 * time.Millisecond}
+			client := Client{
+				url:     "http://test.com",
+				client:  fs.client(),
+				index:   "test",
+				timeout: time.Second,
+				log:     test.Logger(),
+			}
+			WithQueryConcurrency(c.perRequest, NewQueryLimiter(c.global))(&client)
+			res, err := client.Read(context.Background(), &req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j, r := range res.Results {
+				want := fmt.Sprintf("test%d", j)
+				if len(r.Timeseries) != 1 || r.Timeseries[0].Labels[0].Value != want {
+					t.Fatalf("unexpected result %d: %v, want: %s", j, r, want)
+				}
+			}
+			if fs.maxRunning > c.wannaMax {
+				t.Fatalf("unexpected concurrency: %d, want: %d", fs.maxRunning, c.wannaMax)
+			}
+		})
+	}
+}
+
+func TestClient_ReadStopsDispatching(t *testing.T) {
+	req := prompb.ReadRequest{}
+	for i := 0; i < 6; i++ {
+		req.Queries = append(req.Queries, &prompb.Query{
+			EndTimestampMs: 10,
+			Matchers: []*prompb.LabelMatcher{
+				{
+					Type:  prompb.LabelMatcher_EQ,
+					Name:  "__name__",
+					Value: fmt.Sprintf("test%d", i),
+				},
+			},
+			Hints: &prompb.ReadHints{},
+		})
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cases := []struct {
+		name          string
+		ctx           context.Context
+		limiter       QueryLimiter
+		wannaErr      string
+		wannaRequests int
+	}{
+		{
+			"first error",
+			context.Background(),
+			nil,
+			"create job error",
+			2,
+		},
+		{
+			"cancelled",
+			cancelled,
+			nil,
+			"context canceled",
+			0,
+		},
+		{
+			"waiting for global limit",
+			nil,
+			NewQueryLimiter(1),
+			"context deadline exceeded",
+			0,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fc := &routeClient{routes: []route{
+				{"POST", "/search/jobs", reply(200, `{}`)},
+			}}
+			client := Client{
+				url:     "http://test.com",
+				client:  fc,
+				index:   "test",
+				timeout: time.Second,
+				log:     test.Logger(),
+			}
+			WithQueryConcurrency(1, c.limiter)(&client)
+			ctx := c.ctx
+			if ctx == nil {
+				// all slots are taken by other requests.
+				c.limiter.acquire(context.Background())
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+			}
+			_, err := client.Read(ctx, &req)
+			if err == nil || !strings.HasPrefix(err.Error(), c.wannaErr) {
+				t.Fatalf("unexpected err: %v, want: %s", err, c.wannaErr)
+			}
+			if fc.count() != c.wannaRequests {
+				t.Fatalf("unexpected requests: %v, want: %d", fc.requests, c.wannaRequests)
+			}
+		})
+	}
+}
+
+func TestClient_ReadSearchModes(t *testing.T) {
+	req := prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			{
+				StartTimestampMs: 0,
+				EndTimestampMs:   10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: "test",
+					},
+				},
+				Hints: &prompb.ReadHints{},
+			},
+		},
+	}
+	cases := []struct {
+		name      string
+		mode      string
+		wannaRes  string
+		wannaPath []string
+	}{
+		{
+			"oneshot",
+			SearchModeOneshot,
+			`{"results":[{"timeseries":[{"labels":[{"name":"__name__","value":"test"}],"samples":[{"value":1,"timestamp":1000}]},{"labels":[{"name":"__name__","value":"test"},{"name":"a","value":"b"}],"samples":[{"value":2,"timestamp":2000}]}]}]}`,
+			[]string{"GET /services/catalog/metricstore/dimensions", "POST /services/search/jobs"},
+		},
+		{
+			"export",
+			SearchModeExport,
+			`{"results":[{"timeseries":[{"labels":[{"name":"__name__","value":"test"}],"samples":[{"value":1,"timestamp":1000}]},{"labels":[{"name":"__name__","value":"test"},{"name":"a","value":"b"}],"samples":[{"value":2,"timestamp":2000}]}]}]}`,
+			[]string{"GET /services/catalog/metricstore/dimensions", "POST /services/search/jobs/export"},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fs := &fakeSplunk{
+				fields: []string{"ropee_metric_name", "_time", "ropee_metric_value", "a"},
+				rows: func(url.Values) [][]string {
+					return [][]string{{"test", "1", "1", ""}, {"test", "2", "2", "b"}}
+				},
+			}
+			fc := fs.client()
+			client := Client{
+				url:        "http://test.com",
+				client:     fc,
+				index:      "test",
+				searchMode: c.mode,
+				log:        test.Logger(),
+			}
+			res, err := client.Read(context.Background(), &req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resb, _ := json.Marshal(res)
+			if string(resb) != c.wannaRes {
+				t.Fatalf("unexpected res: %s, want: %s", resb, c.wannaRes)
+			}
+			if strings.Join(fc.requests, ",") != strings.Join(c.wannaPath, ",") {
+				t.Fatalf("unexpected requests: %v, want: %v", fc.requests, c.wannaPath)
+			}
+		})
+	}
+}
+
+func TestClient_ReadSearchModeErrors(t *testing.T) {
+	req := prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			{
+				EndTimestampMs: 10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: "test",
+					},
+				},
+				Hints: &prompb.ReadHints{},
+			},
+		},
+	}
+	fatal := `{"messages":[{"type":"FATAL","text":"Error in 'mstats' command"}]}`
+	cases := []struct {
+		name     string
+		mode     string
+		status   int
+		body     string
+		wannaErr string
+	}{
+		{
+			"oneshot error status",
+			SearchModeOneshot,
+			400,
+			fatal,
+			"status 400: FATAL: Error in 'mstats' command",
+		},
+		{
+			"oneshot fatal message",
+			SearchModeOneshot,
+			200,
+			fatal,
+			"oneshot search failed: FATAL: Error in 'mstats' command",
+		},
+		{
+			"export error status",
+			SearchModeExport,
+			400,
+			fatal,
+			"status 400: FATAL: Error in 'mstats' command",
+		},
+		{
+			"export unauthorized",
+			SearchModeExport,
+			401,
+			`{"messages":[{"type":"WARN","text":"call not properly authenticated"}]}`,
+			"status 401: WARN: call not properly authenticated",
+		},
+		{
+			"export fatal message",
+			SearchModeExport,
+			200,
+			`{"preview":false,"offset":0,"result":{"ropee_metric_name":"test","_time":"1","ropee_metric_value":"1"}}
+{"preview":false,"messages":[{"type":"FATAL","text":"Error in 'mstats' command"}]}`,
+			"export search failed: FATAL: Error in 'mstats' command",
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			client := Client{
+				url: "http://test.com",
+				client: &routeClient{routes: []route{
+					{"POST", "/search/jobs/export", reply(c.status, c.body)},
+					{"POST", "/search/jobs", reply(c.status, c.body)},
+				}},
+				index:      "test",
+				timeout:    time.Second,
+				searchMode: c.mode,
+				log:        test.Logger(),
+			}
+			_, err := client.Read(context.Background(), &req)
+			if err == nil || !strings.Contains(err.Error(), c.wannaErr) {
+				t.Fatalf("unexpected err: %v, want: %s", err, c.wannaErr)
+			}
+		})
+	}
+}
+
+func TestClient_ReadJobLifecycle(t *testing.T) {
+	req := prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			{
+				StartTimestampMs: 0,
+				EndTimestampMs:   10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: "test",
+					},
+				},
+				Hints: &prompb.ReadHints{},
+			},
+		},
+	}
+	cases := []struct {
+		name        string
+		status      string
+		timeout     time.Duration
+		wannaErr    string
+		wannaCancel bool
+	}{
+		{
+			"failed job",
+			`{"entry":[{"content":{"isDone":true,"isFailed":true,"dispatchState":"FAILED","messages":[{"type":"FATAL","text":"Error in 'mstats' command"}]}}]}`,
+			time.Second,
+			"search job 1 failed: FATAL: Error in 'mstats' command",
+			true,
+		},
+		{
+			"timeout",
+			`{"entry":[{"content":{"isDone":false,"dispatchState":"RUNNING"}}]}`,
+			300 * time.Millisecond,
+			"context deadline exceeded",
+			true,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fs := &fakeSplunk{rows: sampleRows(1), status: c.status}
+			client := Client{
+				url:     "http://test.com",
+				client:  fs.client(),
+				index:   "test",
+				timeout: time.Second,
+				jobTTL:  time.Minute,
+				log:     test.Logger(),
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			defer cancel()
+			_, err := client.Read(ctx, &req)
+			if err == nil || err.Error() != c.wannaErr {
+				t.Fatalf("unexpected err: %v, want: %s", err, c.wannaErr)
+			}
+			if cancelled := reflect.DeepEqual(fs.cancelled, []string{"1"}); cancelled != c.wannaCancel {
+				t.Fatalf("unexpected cancelled: %v, want: %v", fs.cancelled, c.wannaCancel)
+			}
+			if ttl := fs.search("1").Get("timeout"); ttl != "60" {
+				t.Fatalf("unexpected job ttl: %s, want: 60", ttl)
+			}
+		})
+	}
+}
+
+func TestClient_ReadPaging(t *testing.T) {
+	req := prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			{
+				StartTimestampMs: 0,
+				EndTimestampMs:   10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: "test",
+					},
+				},
+				Hints: &prompb.ReadHints{},
+			},
+		},
+	}
+	cases := []struct {
+		name         string
+		mode         string
+		total        int
+		failOffset   int
+		maxSamples   int
+		wannaSamples int
+		wannaOffsets []string
+		wannaErr     string
+	}{
+		{
+			"job paged",
+			SearchModeJob,
+			resultsPageSize + 1,
+			0,
+			0,
+			resultsPageSize + 1,
+			[]string{"0", strconv.Itoa(resultsPageSize)},
+			"",
+		},
+		{
+			"job later page fails",
+			SearchModeJob,
+			resultsPageSize + 1,
+			resultsPageSize,
+			0,
+			0,
+			nil,
+			"status 404: FATAL: Unknown sid.",
+		},
+		{
+			"job result count exceeds limit",
+			SearchModeJob,
+			11,
+			0,
+			10,
+			0,
+			nil,
+			"exceeds the limit of 10 samples",
+		},
+		{
+			"job within limit",
+			SearchModeJob,
+			10,
+			0,
+			10,
+			10,
+			[]string{"0"},
+			"",
+		},
+		{
+			"export exceeds limit",
+			SearchModeExport,
+			11,
+			0,
+			10,
+			0,
+			nil,
+			"exceeds the limit of 10 samples",
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fs := &fakeSplunk{rows: sampleRows(c.total), failOffset: c.failOffset}
+			client := Client{
+				url:        "http://test.com",
+				client:     fs.client(),
+				index:      "test",
+				timeout:    time.Second,
+				searchMode: c.mode,
+				maxSamples: c.maxSamples,
+				log:        test.Logger(),
+			}
+			res, err := client.Read(context.Background(), &req)
+			if c.wannaErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wannaErr) {
+					t.Fatalf("unexpected err: %v, want: %s", err, c.wannaErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			samples := 0
+			for _, ts := range res.Results[0].Timeseries {
+				samples += len(ts.Samples)
+			}
+			if samples != c.wannaSamples {
+				t.Fatalf("unexpected samples: %d, want: %d", samples, c.wannaSamples)
+			}
+			if !reflect.DeepEqual(fs.offsets, c.wannaOffsets) {
+				t.Fatalf("unexpected offsets: %v, want: %v", fs.offsets, c.wannaOffsets)
+			}
+		})
+	}
+}
+
+func TestClient_ReadExportStreams(t *testing.T) {
+	query := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/search/jobs/export") {
+			w.Write([]byte(`{"entry":[]}`))
+			return
+		}
+		query <- r.URL.Query()
+		for i := 0; i < 11; i++ {
+			fmt.Fprintf(w, `{"preview":false,"result":{"ropee_metric_name":"test","_time":"%d","ropee_metric_value":"1"}}`+"\n", i)
+		}
+		w.(http.Flusher).Flush()
+		// a large export is still running.
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client := Client{
+		url:        server.URL,
+		client:     http.DefaultClient,
+		index:      "test",
+		timeout:    5 * time.Second,
+		searchMode: SearchModeExport,
+		maxSamples: 10,
+		log:        test.Logger(),
+	}
+	started := time.Now()
+	_, err := client.Read(context.Background(), &prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			{
+				EndTimestampMs: 10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: "test",
+					},
+				},
+				Hints: &prompb.ReadHints{},
+			},
+		},
+	})
+	if _, ok := err.(*TooManySamplesError); !ok {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if time.Since(started) > time.Second {
+		t.Fatalf("export not aborted at the sample limit, took %s", time.Since(started))
+	}
+	if q := <-query; q.Get("count") != "" {
+		t.Fatalf("unexpected export params: %v", q)
+	}
+}
+
+func TestSearchParams(t *testing.T) {
+	cases := []struct {
+		start, end    int64
+		wannaEarliest string
+		wannaLatest   string
+	}{
+		{0, 10000, "0.000", "10.001"},
+		{1500, 2999, "1.500", "3.000"},
+		{1571300000123, 1571300000999, "1571300000.123", "1571300001.000"},
+	}
+	for i, c := range cases {
+		params := searchParams("search", c.start, c.end)
+		if params["earliest_time"] != c.wannaEarliest || params["latest_time"] != c.wannaLatest {
+			t.Fatalf("test-%d: unexpected range: %s-%s, want: %s-%s", i,
+				params["earliest_time"], params["latest_time"], c.wannaEarliest, c.wannaLatest)
+		}
+	}
+}
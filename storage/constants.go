@@ -4,3 +4,24 @@ const (
 	CommonMetricName  = "ropee_metric_name"
 	CommonMetricValue = "ropee_metric_value"
 )
+
+// HEC formats of written events.
+const (
+	// HECFormatEvent sends `name{labels} value` lines, which need the transforms from README.
+	HECFormatEvent = "event"
+	// HECFormatMetric sends native metric events with metric_name, _value and dimension fields.
+	HECFormatMetric = "metric"
+	// HECFormatMultiMetric groups series sharing labels and timestamp into one multiple-measurement
+	// metric event, it needs splunk 8.0 or later.
+	HECFormatMultiMetric = "multi-metric"
+)
+
+// Search execution modes.
+const (
+	// SearchModeJob creates a search job and polls it until it is done.
+	SearchModeJob = "job"
+	// SearchModeOneshot runs the search in one blocking request.
+	SearchModeOneshot = "oneshot"
+	// SearchModeExport streams results from the export endpoint.
+	SearchModeExport = "export"
+)
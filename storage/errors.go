@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// HEC status codes, see https://docs.splunk.com/Documentation/Splunk/latest/Data/TroubleshootHTTPEventCollector
+const (
+	hecCodeSuccess             = 0
+	hecCodeNoData              = 5
+	hecCodeInvalidDataFormat   = 6
+	hecCodeEventFieldRequired  = 12
+	hecCodeEventFieldBlank     = 13
+	hecCodeIndexedFieldsHandle = 15
+)
+
+type hecResponse struct {
+	Text               string `json:"text"`
+	Code               int    `json:"code"`
+	InvalidEventNumber *int   `json:"invalid-event-number"`
+}
+
+// HECError is returned when splunk HEC rejects a request.
+type HECError struct {
+	Status int
+	Code   int
+	Text   string
+	// InvalidEventNumber is the index of the first rejected event in the batch, -1 if unknown.
+	InvalidEventNumber int
+}
+
+func newHECError(status int, body []byte) *HECError {
+	e := &HECError{
+		Status:             status,
+		Code:               -1,
+		InvalidEventNumber: -1,
+	}
+	var resp hecResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		e.Text = string(body)
+		return e
+	}
+	e.Code = resp.Code
+	e.Text = resp.Text
+	if resp.InvalidEventNumber != nil {
+		e.InvalidEventNumber = *resp.InvalidEventNumber
+	}
+	return e
+}
+
+func (e *HECError) Error() string {
+	if e.InvalidEventNumber >= 0 {
+		return fmt.Sprintf("hec error, status: %d, code: %d, text: %s, invalid event number: %d",
+			e.Status, e.Code, e.Text, e.InvalidEventNumber)
+	}
+	return fmt.Sprintf("hec error, status: %d, code: %d, text: %s", e.Status, e.Code, e.Text)
+}
+
+// Recoverable reports whether sending the same events again may succeed.
+// Only malformed data is treated as permanent, token or index problems
+// are configuration errors and the data should be kept until they are fixed.
+func (e *HECError) Recoverable() bool {
+	switch e.Code {
+	case hecCodeNoData, hecCodeInvalidDataFormat, hecCodeEventFieldRequired,
+		hecCodeEventFieldBlank, hecCodeIndexedFieldsHandle:
+		return false
+	}
+	if e.Code < 0 && e.Status == http.StatusBadRequest {
+		return false
+	}
+	return true
+}
+
+// IsRecoverable reports whether the request which caused err should be retried.
+// Errors not produced by splunk (e.g. network errors) are always recoverable.
+func IsRecoverable(err error) bool {
+	if r, ok := err.(interface{ Recoverable() bool }); ok {
+		return r.Recoverable()
+	}
+	return true
+}
+
+// TooManySamplesError is returned when a query matches more samples than allowed.
+type TooManySamplesError struct {
+	Limit int
+}
+
+func (e *TooManySamplesError) Error() string {
+	return fmt.Sprintf("query exceeds the limit of %d samples, narrow the matchers or the time range", e.Limit)
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kebe7jun/ropee/metrics"
+)
+
+// HealthChecker probes the HEC and the management API of splunk. The result is cached for ttl,
+// so that frequent readiness probes of many replicas do not load splunk.
+type HealthChecker struct {
+	url, hecUrl  string
+	client       HTTPClient
+	hecClient    HTTPClient
+	ttl, timeout time.Duration
+
+	mtx     sync.Mutex
+	checked time.Time
+	err     error
+	now     func() time.Time
+}
+
+// NewHealthChecker probes url and hecUrl with the http clients used for them, a probe fails after timeout.
+func NewHealthChecker(url, hecUrl string, client, hecClient HTTPClient, ttl, timeout time.Duration) *HealthChecker {
+	return &HealthChecker{
+		url:       url,
+		hecUrl:    hecUrl,
+		client:    client,
+		hecClient: hecClient,
+		ttl:       ttl,
+		timeout:   timeout,
+		now:       time.Now,
+	}
+}
+
+// Check returns the cached result of the last probe or probes splunk again once it expired.
+func (h *HealthChecker) Check(ctx context.Context) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if !h.checked.IsZero() && h.now().Before(h.checked.Add(h.ttl)) {
+		return h.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	h.err = h.probe(ctx)
+	h.checked = h.now()
+	return h.err
+}
+
+func (h *HealthChecker) probe(ctx context.Context) error {
+	// the HEC health endpoint also fails when the indexer queues are full.
+	hecErr := h.get(ctx, h.hecClient, h.hecUrl, "/services/collector/health", func(status int, body []byte) error {
+		if status != http.StatusOK {
+			return newHECError(status, body)
+		}
+		return nil
+	})
+	setUp("hec", hecErr)
+	// probes have no credentials, any response but a server error shows the api is reachable.
+	restErr := h.get(ctx, h.client, h.url, "/services/server/info", func(status int, body []byte) error {
+		if status >= 500 {
+			return fmt.Errorf("status: %d, body: %s", status, body)
+		}
+		return nil
+	})
+	setUp("rest", restErr)
+	if hecErr != nil {
+		return fmt.Errorf("splunk hec: %s", hecErr)
+	}
+	if restErr != nil {
+		return fmt.Errorf("splunk management api: %s", restErr)
+	}
+	return nil
+}
+
+func (h *HealthChecker) get(ctx context.Context, client HTTPClient, baseUrl, reqPath string, check func(int, []byte) error) error {
+	reqUrl, err := urlJoin(baseUrl, reqPath)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", reqUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "ropee client/1.0")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return check(resp.StatusCode, body)
+}
+
+func setUp(endpoint string, err error) {
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	metrics.SplunkUp.WithLabelValues(endpoint).Set(up)
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker_Check(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  map[string]int
+		wantErr string
+	}{
+		{
+			"healthy",
+			map[string]int{"/services/collector/health": 200, "/services/server/info": 401},
+			"",
+		},
+		{
+			"hec unhealthy",
+			map[string]int{"/services/collector/health": 503, "/services/server/info": 200},
+			"splunk hec: hec error, status: 503, code: 18",
+		},
+		{
+			"management api unreachable",
+			map[string]int{"/services/collector/health": 200},
+			"splunk management api: connection refused",
+		},
+		{
+			"management api error",
+			map[string]int{"/services/collector/health": 200, "/services/server/info": 500},
+			"splunk management api: status: 500",
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			// the paths missing in status fail to connect.
+			client := &routeClient{unrouted: fmt.Errorf("connection refused")}
+			for p, code := range c.status {
+				client.routes = append(client.routes, route{"GET", p, reply(code, `{"text":"HEC is unhealthy, queues are full","code":18}`)})
+			}
+			h := NewHealthChecker("https://127.0.0.1:8089", "https://127.0.0.1:8088", client, client, time.Minute, time.Second)
+			err := h.Check(context.Background())
+			if c.wantErr == "" && err != nil || c.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), c.wantErr)) {
+				t.Fatalf("unexpected error: %v, want: %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestHealthChecker_Cache(t *testing.T) {
+	client := &routeClient{routes: []route{
+		{"GET", "/services/collector/health", reply(200, `{"text":"HEC is healthy","code":17}`)},
+		{"GET", "/services/server/info", reply(200, `{}`)},
+	}}
+	h := NewHealthChecker("https://127.0.0.1:8089", "https://127.0.0.1:8088", client, client, time.Minute, time.Second)
+	now := time.Now()
+	h.now = func() time.Time {
+		return now
+	}
+	for i := 0; i < 3; i++ {
+		if err := h.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.count() != 2 {
+		t.Fatalf("unexpected probes: %d, want: 2", client.count())
+	}
+	now = now.Add(time.Minute)
+	client.routes[0].handle = reply(503, `{"text":"HEC is unhealthy, queues are full","code":18}`)
+	if err := h.Check(context.Background()); err == nil {
+		t.Fatal("expired result not probed again")
+	}
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ReadHints fields added by prometheus 2.15, which the vendored prompb does not know.
+const (
+	hintsGroupingField = 5
+	hintsByField       = 6
+	hintsRangeMsField  = 7
+)
+
+// readHintsExt holds the grouping of the aggregation enclosing the selector (By tells whether it
+// is a `by` or a `without` list) and the range of the enclosing range function.
+type readHintsExt struct {
+	Grouping []string
+	By       bool
+	RangeMs  int64
+}
+
+// hintsExtension decodes the newer ReadHints fields, which prompb keeps as unrecognized bytes.
+func hintsExtension(hints *prompb.ReadHints) readHintsExt {
+	var ext readHintsExt
+	if hints == nil {
+		return ext
+	}
+	b := proto.NewBuffer(hints.XXX_unrecognized)
+	for {
+		key, err := b.DecodeVarint()
+		if err != nil {
+			return ext
+		}
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case proto.WireVarint:
+			v, err := b.DecodeVarint()
+			if err != nil {
+				return ext
+			}
+			switch field {
+			case hintsByField:
+				ext.By = v != 0
+			case hintsRangeMsField:
+				ext.RangeMs = int64(v)
+			}
+		case proto.WireBytes:
+			v, err := b.DecodeRawBytes(false)
+			if err != nil {
+				return ext
+			}
+			if field == hintsGroupingField {
+				ext.Grouping = append(ext.Grouping, string(v))
+			}
+		case proto.WireFixed64:
+			if _, err := b.DecodeFixed64(); err != nil {
+				return ext
+			}
+		case proto.WireFixed32:
+			if _, err := b.DecodeFixed32(); err != nil {
+				return ext
+			}
+		default:
+			return ext
+		}
+	}
+}
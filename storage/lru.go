@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is a size bounded map whose entries expire after ttl, ttl 0 means entries never expire.
+// The least recently used entries are evicted beyond size, size 0 means no limit.
+type lruCache struct {
+	mtx   sync.Mutex
+	size  int
+	ttl   time.Duration
+	lru   *list.List
+	items map[string]*list.Element
+	now   func() time.Time
+	// onLen is called with the number of entries after every change.
+	onLen func(int)
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration, onLen func(int)) *lruCache {
+	return &lruCache{
+		size:  size,
+		ttl:   ttl,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+		now:   time.Now,
+		onLen: onLen,
+	}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if c.ttl > 0 && !c.now().Before(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *lruCache) set(key string, value interface{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry := &lruEntry{
+		key:     key,
+		value:   value,
+		expires: c.now().Add(c.ttl),
+	}
+	if e, ok := c.items[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(entry)
+	for c.size > 0 && c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	c.onLen(c.lru.Len())
+}
+
+func (c *lruCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.items, e.Value.(*lruEntry).key)
+	c.onLen(c.lru.Len())
+}
+
+func (c *lruCache) purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.onLen(0)
+}
+
+func (c *lruCache) len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.lru.Len()
+}
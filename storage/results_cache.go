@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	resultsCacheSuffix = ".json"
+	// resultsCacheSweepInterval is the minimum time between two sweeps of the cache directory.
+	resultsCacheSweepInterval = time.Minute
+)
+
+// ResultsCache caches search results per time bucket. Buckets are multiples of the query step
+// aligned to the epoch, so that the mstats spans of a bucket are the same for every query range.
+// Only buckets older than freshness are cached as splunk may still index samples of recent ones.
+// A nil *ResultsCache caches nothing.
+type ResultsCache struct {
+	bucket    time.Duration
+	freshness time.Duration
+	ttl       time.Duration
+	size      int
+	dir       string
+	entries   *lruCache
+	log       log.Logger
+	now       func() time.Time
+
+	sweepMtx  sync.Mutex
+	lastSweep time.Time
+}
+
+// NewResultsCache keeps up to size buckets in memory for ttl, ttl 0 means buckets never expire.
+// With dir set buckets are also written to disk and survive restarts, the directory is swept
+// of expired files and of the oldest files beyond size on start and while buckets are stored.
+func NewResultsCache(size int, bucket, freshness, ttl time.Duration, dir string, logger log.Logger) (*ResultsCache, error) {
+	c := &ResultsCache{
+		bucket:    bucket,
+		freshness: freshness,
+		ttl:       ttl,
+		size:      size,
+		dir:       dir,
+		entries: newLRUCache(size, ttl, func(n int) {
+			metrics.ResultsCacheEntries.Set(float64(n))
+		}),
+		log: logger,
+		now: time.Now,
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := c.sweep(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// sweep removes the expired files and the least recently stored files beyond size from dir.
+func (c *ResultsCache) sweep() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	kept := make([]os.FileInfo, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), resultsCacheSuffix) {
+			continue
+		}
+		if c.expired(f.ModTime()) {
+			os.Remove(filepath.Join(c.dir, f.Name()))
+			continue
+		}
+		kept = append(kept, f)
+	}
+	if c.size <= 0 || len(kept) <= c.size {
+		return nil
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].ModTime().After(kept[j].ModTime())
+	})
+	for _, f := range kept[c.size:] {
+		os.Remove(filepath.Join(c.dir, f.Name()))
+	}
+	return nil
+}
+
+// maybeSweep sweeps dir unless it was swept within resultsCacheSweepInterval.
+func (c *ResultsCache) maybeSweep() {
+	c.sweepMtx.Lock()
+	now := c.now()
+	if now.Sub(c.lastSweep) < resultsCacheSweepInterval {
+		c.sweepMtx.Unlock()
+		return
+	}
+	c.lastSweep = now
+	c.sweepMtx.Unlock()
+	if err := c.sweep(); err != nil {
+		level.Warn(c.log).Log("msg", "sweep results cache dir error", "err", err)
+	}
+}
+
+func (c *ResultsCache) expired(stored time.Time) bool {
+	return c.ttl > 0 && !c.now().Before(stored.Add(c.ttl))
+}
+
+// bucketMs returns the bucket size for a query step, the configured bucket rounded up to a multiple of the step.
+func (c *ResultsCache) bucketMs(stepSeconds int64) int64 {
+	step := stepSeconds * 1000
+	b := int64(c.bucket / time.Millisecond)
+	if b < step {
+		return step
+	}
+	return (b + step - 1) / step * step
+}
+
+func (c *ResultsCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+resultsCacheSuffix)
+}
+
+func (c *ResultsCache) load(key string) (*jobResultPreview, bool) {
+	if v, ok := c.entries.get(key); ok {
+		metrics.ResultsCacheHits.Inc()
+		return v.(*jobResultPreview), true
+	}
+	if c.dir != "" {
+		p := c.path(key)
+		if info, err := os.Stat(p); err == nil && !c.expired(info.ModTime()) {
+			var res jobResultPreview
+			b, err := ioutil.ReadFile(p)
+			if err == nil && json.Unmarshal(b, &res) == nil {
+				c.entries.set(key, &res)
+				metrics.ResultsCacheHits.Inc()
+				return &res, true
+			}
+			level.Warn(c.log).Log("msg", "invalid results cache file", "file", p, "err", err)
+		}
+	}
+	metrics.ResultsCacheMisses.Inc()
+	return nil, false
+}
+
+func (c *ResultsCache) store(key string, res *jobResultPreview) {
+	c.entries.set(key, res)
+	if c.dir == "" {
+		return
+	}
+	b, err := json.Marshal(res)
+	if err == nil {
+		p := c.path(key)
+		if err = ioutil.WriteFile(p+".tmp", b, 0644); err == nil {
+			err = os.Rename(p+".tmp", p)
+		}
+	}
+	if err != nil {
+		level.Warn(c.log).Log("msg", "write results cache file error", "err", err)
+	}
+	c.maybeSweep()
+}
+
+// Invalidate removes all cached buckets from memory and disk.
+func (c *ResultsCache) Invalidate() {
+	if c == nil {
+		return
+	}
+	c.entries.purge()
+	if c.dir == "" {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(c.dir, "*"+resultsCacheSuffix))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// rowsInRange returns the rows of res with a _time in [start, end).
+func rowsInRange(res *jobResultPreview, start, end int64) *jobResultPreview {
+	timeIndex := -1
+	for i, f := range res.Fields {
+		if f == "_time" {
+			timeIndex = i
+		}
+	}
+	part := &jobResultPreview{Fields: res.Fields, Rows: make([][]string, 0)}
+	for _, row := range res.Rows {
+		if timeIndex < 0 || timeIndex >= len(row) {
+			continue
+		}
+		if t := parseSplunkTime(row[timeIndex]); t >= start && t < end {
+			part.Rows = append(part.Rows, row)
+		}
+	}
+	return part
+}
+
+// cachedSearch takes the completed buckets of the query range from the results cache,
+// only the missing buckets and the recent tail of the range are searched in splunk.
+// Adjacent missing buckets are fetched with one search.
+func (c *Client) cachedSearch(ctx context.Context, q *prompb.Query, search string) (*jobResultPreview, error) {
+	rc := c.resultsCache
+	if rc == nil {
+		return c.search(ctx, search, q.StartTimestampMs, q.EndTimestampMs)
+	}
+	step := queryStep(q, c.readOpts)
+	bucket := rc.bucketMs(step)
+	complete := (rc.now().Add(-rc.freshness).UnixNano() / 1e6) / bucket * bucket
+	b := q.StartTimestampMs / bucket * bucket
+	if b+bucket > complete {
+		return c.search(ctx, search, q.StartTimestampMs, q.EndTimestampMs)
+	}
+	key := func(start int64) string {
+		return strings.Join([]string{c.user, search, fmt.Sprint(bucket), fmt.Sprint(start)}, "\xff")
+	}
+	res := &jobResultPreview{}
+	missing := make([]int64, 0)
+	fetch := func() error {
+		if len(missing) == 0 {
+			return nil
+		}
+		r, err := c.search(ctx, search, missing[0], missing[len(missing)-1]+bucket)
+		if err != nil {
+			return err
+		}
+		for _, start := range missing {
+			part := rowsInRange(r, start, start+bucket)
+			rc.store(key(start), part)
+			res.appendRows(part)
+		}
+		missing = missing[:0]
+		return nil
+	}
+	for ; b+bucket <= complete && b <= q.EndTimestampMs; b += bucket {
+		part, ok := rc.load(key(b))
+		if !ok {
+			missing = append(missing, b)
+			continue
+		}
+		if err := fetch(); err != nil {
+			return nil, err
+		}
+		res.appendRows(part)
+	}
+	if err := fetch(); err != nil {
+		return nil, err
+	}
+	if b <= q.EndTimestampMs {
+		r, err := c.search(ctx, search, b, q.EndTimestampMs)
+		if err != nil {
+			return nil, err
+		}
+		res.appendRows(r)
+	}
+	// like a search of the whole range, the span containing the start is kept with its aligned _time.
+	res = rowsInRange(res, q.StartTimestampMs/(step*1000)*(step*1000), q.EndTimestampMs+1)
+	if err := c.checkSamples(len(res.Rows)); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
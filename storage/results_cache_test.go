@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kebe7jun/ropee/test"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// minuteRows returns one sample per minute of the searched range, labeled with the minute aligned
+// _time like mstats spans.
+func minuteRows(form url.Values) [][]string {
+	earliest, _ := strconv.ParseFloat(form.Get("earliest_time"), 64)
+	latest, _ := strconv.ParseFloat(form.Get("latest_time"), 64)
+	earliestMs, latestMs := int64(math.Round(earliest*1000)), int64(math.Round(latest*1000))
+	rows := make([][]string, 0)
+	for t := earliestMs / 60000 * 60000; t < latestMs; t += 60000 {
+		rows = append(rows, []string{"test", strconv.FormatInt(t/1000, 10), strconv.FormatInt(t/1000, 10)})
+	}
+	return rows
+}
+
+func TestClient_ResultsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ropee-results-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newCache := func() *ResultsCache {
+		rc, err := NewResultsCache(100, time.Hour, 10*time.Minute, 0, dir, test.Logger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.now = func() time.Time { return time.Unix(36000, 0) }
+		return rc
+	}
+	query := func(start int64) *prompb.ReadRequest {
+		return &prompb.ReadRequest{
+			Queries: []*prompb.Query{
+				{
+					StartTimestampMs: start * 1000,
+					EndTimestampMs:   36000 * 1000,
+					Matchers: []*prompb.LabelMatcher{
+						{
+							Type:  prompb.LabelMatcher_EQ,
+							Name:  "__name__",
+							Value: "test",
+						},
+					},
+					Hints: &prompb.ReadHints{StepMs: 60000},
+				},
+			},
+		}
+	}
+	cache := newCache()
+	cases := []struct {
+		name          string
+		cache         *ResultsCache
+		start         int64
+		wannaSearches []string
+		wannaSamples  int
+	}{
+		{
+			"cold",
+			cache,
+			0,
+			[]string{"0.000-32400.001", "32400.000-36000.001"},
+			601,
+		},
+		{
+			"warm",
+			cache,
+			0,
+			[]string{"32400.000-36000.001"},
+			601,
+		},
+		{
+			"unaligned start",
+			cache,
+			1830,
+			[]string{"32400.000-36000.001"},
+			571,
+		},
+		{
+			"unaligned start without cache",
+			nil,
+			1830,
+			[]string{"1830.000-36000.001"},
+			571,
+		},
+		{
+			"from disk",
+			newCache(),
+			0,
+			[]string{"32400.000-36000.001"},
+			601,
+		},
+		{
+			"no complete bucket",
+			cache,
+			33000,
+			[]string{"33000.000-36000.001"},
+			51,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			fs := &fakeSplunk{rows: minuteRows}
+			client := Client{
+				url:          "http://test.com",
+				client:       fs.client(),
+				index:        "test",
+				timeout:      time.Second,
+				searchMode:   SearchModeOneshot,
+				resultsCache: c.cache,
+				log:          test.Logger(),
+			}
+			res, err := client.Read(context.Background(), query(c.start))
+			if err != nil {
+				t.Fatal(err)
+			}
+			searches := make([]string, 0)
+			for _, form := range fs.searches {
+				searches = append(searches, form.Get("earliest_time")+"-"+form.Get("latest_time"))
+			}
+			if !reflect.DeepEqual(searches, c.wannaSearches) {
+				t.Fatalf("unexpected searches: %v, want: %v", searches, c.wannaSearches)
+			}
+			samples := res.Results[0].Timeseries[0].Samples
+			if len(samples) != c.wannaSamples {
+				t.Fatalf("unexpected samples: %d, want: %d", len(samples), c.wannaSamples)
+			}
+			for j, s := range samples {
+				if s.Value != float64(s.Timestamp/1000) || (j > 0 && s.Timestamp-samples[j-1].Timestamp != 60000) {
+					t.Fatalf("unexpected sample %d: %v", j, s)
+				}
+			}
+		})
+	}
+}
+
+func TestResultsCache_BucketMs(t *testing.T) {
+	rc := &ResultsCache{bucket: time.Hour}
+	cases := []struct {
+		step  int64
+		wanna int64
+	}{
+		{10, 3600000},
+		{7, 3605000},
+		{7200, 7200000},
+	}
+	for i, c := range cases {
+		if got := rc.bucketMs(c.step); got != c.wanna {
+			t.Fatalf("test-%d: unexpected bucket: %d, want: %d", i, got, c.wanna)
+		}
+	}
+}
+
+func TestResultsCache_Sweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ropee-results-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rc, err := NewResultsCache(2, time.Hour, 10*time.Minute, time.Hour, dir, test.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rc.now = func() time.Time { return now }
+	// stored ago per key, "expired" is older than the ttl and "oldest" exceeds the size.
+	ages := map[string]time.Duration{
+		"expired": 2 * time.Hour,
+		"oldest":  3 * time.Minute,
+		"older":   2 * time.Minute,
+		"newest":  time.Minute,
+	}
+	for key, age := range ages {
+		rc.store(key, &jobResultPreview{})
+		if err := os.Chtimes(rc.path(key), now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the sweep by the first store is recent.
+	rc.store("skipped", &jobResultPreview{})
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+resultsCacheSuffix)); len(files) != 5 {
+		t.Fatalf("unexpected files before the sweep interval: %v", files)
+	}
+	os.Remove(rc.path("skipped"))
+
+	now = now.Add(resultsCacheSweepInterval)
+	rc.maybeSweep()
+	for key := range ages {
+		_, err := os.Stat(rc.path(key))
+		if kept := err == nil; kept != (key == "older" || key == "newest") {
+			t.Fatalf("unexpected file of %s kept: %v", key, kept)
+		}
+	}
+}
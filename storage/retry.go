@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/metrics"
+)
+
+// RetryPolicy describes how failed requests to splunk are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, values below 1 mean no retry.
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Jitter is the fraction (0-1) of each backoff which is randomized.
+	Jitter float64
+	// RetryableStatus contains the http status codes which are retried.
+	RetryableStatus map[int]bool
+}
+
+// DefaultRetryPolicy retries throttled and busy responses a few times.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseBackoff: 200 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+	Jitter:      0.2,
+	RetryableStatus: map[int]bool{
+		http.StatusTooManyRequests:    true,
+		http.StatusBadGateway:         true,
+		http.StatusServiceUnavailable: true,
+		http.StatusGatewayTimeout:     true,
+	},
+}
+
+// WithRetryPolicy sets the retry policy for both HEC and REST requests.
+func WithRetryPolicy(p RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// backoff returns the wait time before the given retry, attempt starts from 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseBackoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		delta := float64(d) * p.Jitter
+		d = time.Duration(float64(d) - delta + rand.Float64()*2*delta)
+	}
+	return d
+}
+
+// doWithRetry sends the request built by newReq until it succeeds, returns a non retryable
+// status or the attempts are used up. newReq is called for every attempt so that the body can be re-read.
+// Transport errors are only retried with retryErrors, a request failing in transit may have reached splunk.
+func (c *Client) doWithRetry(ctx context.Context, client HTTPClient, kind string, retryErrors bool, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		httpReq, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		httpResp, err := client.Do(httpReq.WithContext(ctx))
+		last := attempt >= c.retry.MaxAttempts
+		if err == nil && (last || !c.retry.RetryableStatus[httpResp.StatusCode]) {
+			return httpResp, nil
+		}
+		if err != nil && (last || !retryErrors) {
+			return nil, err
+		}
+		if err == nil {
+			io.Copy(ioutil.Discard, httpResp.Body)
+			httpResp.Body.Close()
+			level.Debug(c.log).Log("type", kind, "msg", "retry request", "attempt", attempt, "status", httpResp.StatusCode)
+		} else {
+			level.Debug(c.log).Log("type", kind, "msg", "retry request", "attempt", attempt, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return nil, err
+		case <-time.After(c.retry.backoff(attempt)):
+		}
+		metrics.SplunkRequestRetries.WithLabelValues(kind).Inc()
+	}
+}
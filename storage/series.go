@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// labelSep separates label names and values in series keys, it never occurs in valid UTF-8.
+const labelSep = '\xff'
+
+// seriesKey identifies a series by its sorted label name/value pairs, labels must be sorted by name.
+func seriesKey(labels []prompb.Label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte(labelSep)
+		b.WriteString(l.Value)
+		b.WriteByte(labelSep)
+	}
+	return b.String()
+}
+
+// rowsToTimeSeries converts mstats result rows to series. Empty dimensions, which mstats
+// emits for series without a `by` field, are omitted as prometheus has no empty labels.
+// Series are returned in the order they first appear.
+func rowsToTimeSeries(fields []string, rows [][]string) []*prompb.TimeSeries {
+	keysMap := make(map[string]*prompb.TimeSeries)
+	timeSeries := make([]*prompb.TimeSeries, 0)
+	for _, values := range rows {
+		l := make([]prompb.Label, 0, len(values))
+		var ts int64
+		var value float64
+		for i, v := range values {
+			if i >= len(fields) {
+				break
+			}
+			k := fields[i]
+			if k == CommonMetricName {
+				k = "__name__"
+			}
+			if k == "_time" {
+				ts = parseSplunkTime(v)
+				continue
+			}
+			if k == CommonMetricValue {
+				value, _ = strconv.ParseFloat(v, 64)
+				continue
+			}
+			if v == "" {
+				continue
+			}
+			l = append(l, prompb.Label{
+				Name:  k,
+				Value: v,
+			})
+		}
+		sort.Slice(l, func(i, j int) bool {
+			return l[i].Name < l[j].Name
+		})
+		key := seriesKey(l)
+		sample := prompb.Sample{Timestamp: ts, Value: value}
+		if s, ok := keysMap[key]; ok {
+			s.Samples = append(s.Samples, sample)
+			continue
+		}
+		s := &prompb.TimeSeries{
+			Labels:  l,
+			Samples: []prompb.Sample{sample},
+		}
+		keysMap[key] = s
+		timeSeries = append(timeSeries, s)
+	}
+	for _, s := range timeSeries {
+		s.Samples = sortSamples(s.Samples)
+	}
+	return timeSeries
+}
+
+// parseSplunkTime parses an epoch (e.g. `1571731200.123`) or ISO 8601 `_time`
+// to milliseconds, 0 is returned for invalid values.
+func parseSplunkTime(v string) int64 {
+	if epoch, err := strconv.ParseFloat(v, 64); err == nil {
+		return int64(math.Round(epoch * 1000))
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// sortSamples sorts samples by timestamp as prometheus expects, of samples sharing
+// a timestamp only the last one is kept.
+func sortSamples(samples []prompb.Sample) []prompb.Sample {
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp < samples[j].Timestamp
+	})
+	res := samples[:0]
+	for i, s := range samples {
+		if i+1 < len(samples) && samples[i+1].Timestamp == s.Timestamp {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
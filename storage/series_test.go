@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestRowsToTimeSeries(t *testing.T) {
+	cases := []struct {
+		name     string
+		fields   []string
+		rows     [][]string
+		wannaRes string
+	}{
+		{
+			"values with commas",
+			[]string{"ropee_metric_name", "a", "b", "_time", "ropee_metric_value"},
+			[][]string{
+				{"test", "1,2", "3", "1970-01-01T00:00:01Z", "1"},
+				{"test", "1", "2,3", "1970-01-01T00:00:01Z", "2"},
+			},
+			`[{"labels":[{"name":"__name__","value":"test"},{"name":"a","value":"1,2"},{"name":"b","value":"3"}],"samples":[{"value":1,"timestamp":1000}]},{"labels":[{"name":"__name__","value":"test"},{"name":"a","value":"1"},{"name":"b","value":"2,3"}],"samples":[{"value":2,"timestamp":1000}]}]`,
+		},
+		{
+			"same value in different labels",
+			[]string{"ropee_metric_name", "a", "b", "_time", "ropee_metric_value"},
+			[][]string{
+				{"test", "x", "", "1970-01-01T00:00:01Z", "1"},
+				{"test", "", "x", "1970-01-01T00:00:01Z", "2"},
+			},
+			`[{"labels":[{"name":"__name__","value":"test"},{"name":"a","value":"x"}],"samples":[{"value":1,"timestamp":1000}]},{"labels":[{"name":"__name__","value":"test"},{"name":"b","value":"x"}],"samples":[{"value":2,"timestamp":1000}]}]`,
+		},
+		{
+			"merge samples and sort labels",
+			[]string{"z", "ropee_metric_name", "_time", "ropee_metric_value"},
+			[][]string{
+				{"1", "test", "1970-01-01T00:00:01Z", "1"},
+				{"1", "test", "1970-01-01T00:00:02Z", "2"},
+			},
+			`[{"labels":[{"name":"__name__","value":"test"},{"name":"z","value":"1"}],"samples":[{"value":1,"timestamp":1000},{"value":2,"timestamp":2000}]}]`,
+		},
+		{
+			"millisecond timestamps, sort and dedupe",
+			[]string{"ropee_metric_name", "_time", "ropee_metric_value"},
+			[][]string{
+				{"test", "2019-10-22T08:00:01.500+00:00", "2"},
+				{"test", "2019-10-22T08:00:00.250+00:00", "1"},
+				{"test", "1571731201.5", "3"},
+			},
+			`[{"labels":[{"name":"__name__","value":"test"}],"samples":[{"value":1,"timestamp":1571731200250},{"value":3,"timestamp":1571731201500}]}]`,
+		},
+		{
+			"no fields",
+			nil,
+			nil,
+			`[]`,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			res := rowsToTimeSeries(c.fields, c.rows)
+			resb, _ := json.Marshal(res)
+			if string(resb) != c.wannaRes {
+				t.Fatalf("unexpected res: %s, want: %s", resb, c.wannaRes)
+			}
+		})
+	}
+}
@@ -1,57 +1,437 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/prometheus/prometheus/prompb"
 )
 
-func MakeSPL(query *prompb.Query, c RemoteClient, index string) (string, error) {
+// maxMetricNames limits how many metrics a __name__ matcher may select from the catalog.
+const maxMetricNames = 100
+
+// catalogConcurrency limits the parallel dimension lookups of one query.
+const catalogConcurrency = 8
+
+// ErrNoMatchedMetrics is returned by MakeSPL when no metric matches the __name__ matchers.
+var ErrNoMatchedMetrics = errors.New("no metric matches __name__")
+
+func MakeSPL(ctx context.Context, query *prompb.Query, c RemoteClient, index string, opts ReadOptions) (string, error) {
+	index, err := splIndex(index)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range query.Matchers {
+		if m.Name == "__name__" {
+			continue
+		}
+		if _, err := splField(m.Name); err != nil {
+			return "", err
+		}
+	}
+	metricCond, labels, err := metricNameCondition(ctx, query.Matchers, c)
+	if err != nil {
+		return "", err
+	}
+	step := queryStep(query, opts)
+	hintsExt := hintsExtension(query.Hints)
 	metricName := ""
+	for _, m := range query.Matchers {
+		if m.Name == "__name__" && m.Type == prompb.LabelMatcher_EQ && metricName == "" {
+			metricName = m.Value
+		}
+	}
+	agg := opts.aggregation(metricName, query.Hints)
+	byLabels := make([]string, 0, len(labels))
+	for _, l := range labels {
+		// dimensions from the catalog which are no valid field names can not be grouped by.
+		if field, err := splField(l); err == nil {
+			byLabels = append(byLabels, field)
+		}
+	}
+	where := []string{"index=" + index, metricCond}
+	pipes := ""
 	for _, m := range query.Matchers {
 		if m.Name == "__name__" {
-			if m.Type != prompb.LabelMatcher_EQ {
-				return "", fmt.Errorf("metric_name label macher type error, only euqals supported")
+			continue
+		}
+		if cond, ok := matcherWhere(m); ok {
+			if cond != "" {
+				where = append(where, cond)
+				if pipe := caseSensitivePipe(m); pipe != "" {
+					pipes += pipe
+					// the pipe needs the field, every series matching a positive matcher has it.
+					if field, _ := splField(m.Name); !containsString(byLabels, field) {
+						byLabels = append(byLabels, field)
+					}
+				}
 			}
-			metricName = m.Value
-			break
+			continue
 		}
+		pipes += matcherPipe(m)
 	}
-	if metricName == "" {
-		return "", fmt.Errorf("__name__ is required")
+	ls := strings.Join(byLabels, " ")
+	search := fmt.Sprintf("| mstats %s(_value) as %s where %s span=%ds by metric_name %s",
+		agg, CommonMetricValue, strings.Join(where, " AND "), step, ls)
+	search += pipes
+	if opts.PushdownGrouping {
+		search += groupingPipe(query.Hints, hintsExt, metricName, byLabels)
+	}
+	search += "| rename metric_name as " + CommonMetricName
+	return search, nil
+}
+
+// queryStep returns the mstats span in seconds of query.
+func queryStep(query *prompb.Query, opts ReadOptions) int64 {
+	var step int64
+	if query.Hints != nil {
+		step = query.Hints.StepMs / 1000
 	}
-	step := query.Hints.StepMs / 1000
 	if step < 10 {
 		step = 10
 	}
-	ls := strings.Join(c.MetricLabels(metricName), " ")
-	search := fmt.Sprintf("| mstats latest(_value) as %s where index=%s AND metric_name=%s span=%ds by metric_name %s",
-		CommonMetricValue, index, metricName, step, ls)
-	for _, m := range query.Matchers {
+	hintsExt := hintsExtension(query.Hints)
+	// a range function like rate needs at least two samples in its range.
+	if hintsExt.RangeMs > 0 && step > hintsExt.RangeMs/2000 {
+		step = hintsExt.RangeMs / 2000
+		if step < 1 {
+			step = 1
+		}
+	}
+	if opts.RawMaxRangeMs > 0 && query.EndTimestampMs-query.StartTimestampMs <= opts.RawMaxRangeMs {
+		step = 1
+	}
+	return step
+}
+
+// pushdownFuncs are the aggregations whose result stays the same when prometheus
+// applies them again on the already aggregated series.
+var pushdownFuncs = map[string]bool{
+	"sum": true,
+	"min": true,
+	"max": true,
+	"avg": true,
+}
+
+// groupingPipe aggregates the downsampled series as the aggregation from hints does,
+// so that only one series per group is sent back to prometheus.
+// Functions like rate are never pushed down, prometheus evaluates them again on the result.
+func groupingPipe(hints *prompb.ReadHints, ext readHintsExt, metricName string, labels []string) string {
+	if hints == nil || !pushdownFuncs[hints.Func] {
+		return ""
+	}
+	// the average of per metric averages is only right for a single metric.
+	if hints.Func == "avg" && metricName == "" {
+		return ""
+	}
+	grouping := make(map[string]bool, len(ext.Grouping))
+	for _, g := range ext.Grouping {
+		grouping[g] = true
+	}
+	groupBy := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if grouping[l] == ext.By {
+			groupBy = append(groupBy, l)
+		}
+	}
+	pipe := ""
+	if len(groupBy) > 0 {
+		// stats drops rows with a missing by field, prometheus groups them by the empty value.
+		pipe += fmt.Sprintf("| fillnull value=\"\" %s", strings.Join(groupBy, " "))
+	}
+	return pipe + fmt.Sprintf("| stats %s(%s) as %s by _time metric_name %s",
+		hints.Func, CommonMetricValue, CommonMetricValue, strings.Join(groupBy, " "))
+}
+
+// metricNameCondition renders the __name__ matchers as metric_name condition and returns
+// the dimensions of the selected metrics. Non equality matchers are resolved against the
+// metric catalog, if that is not possible they are translated to metric_name wildcards.
+func metricNameCondition(ctx context.Context, matchers []*prompb.LabelMatcher, c RemoteClient) (string, []string, error) {
+	nameMatchers := make([]*prompb.LabelMatcher, 0, 1)
+	for _, m := range matchers {
 		if m.Name == "__name__" {
+			nameMatchers = append(nameMatchers, m)
+		}
+	}
+	if len(nameMatchers) == 0 {
+		return "", nil, fmt.Errorf("__name__ is required")
+	}
+	if len(nameMatchers) == 1 && nameMatchers[0].Type == prompb.LabelMatcher_EQ {
+		metricName, err := splMetricName(nameMatchers[0].Value)
+		if err != nil {
+			return "", nil, err
+		}
+		return "metric_name=" + metricName, c.MetricLabels(ctx, metricName), nil
+	}
+
+	matchFuncs := make([]func(string) bool, 0, len(nameMatchers))
+	for _, m := range nameMatchers {
+		f, err := valueMatcher(m)
+		if err != nil {
+			return "", nil, err
+		}
+		matchFuncs = append(matchFuncs, f)
+	}
+	catalog := c.LabelValues(ctx, "__name__")
+	names := make([]string, 0)
+	for _, name := range catalog {
+		if strings.Contains(name, "*") {
 			continue
 		}
+		matched := true
+		for _, f := range matchFuncs {
+			matched = matched && f(name)
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	if len(catalog) > 0 && len(names) == 0 {
+		return "", nil, ErrNoMatchedMetrics
+	}
+	if len(names) > 0 && len(names) <= maxMetricNames {
+		sort.Strings(names)
+		quoted := make([]string, 0, len(names))
+		for _, name := range names {
+			quoted = append(quoted, splQuote(name))
+		}
+		return fmt.Sprintf("metric_name IN (%s)", strings.Join(quoted, ", ")), metricsLabels(ctx, c, dimensionPatterns(nameMatchers, names)), nil
+	}
+
+	// the catalog is empty or too many metrics match, try wildcards.
+	conds := make([]string, 0, len(nameMatchers))
+	patterns := make([]string, 0)
+	for _, m := range nameMatchers {
+		metricMatcher := *m
+		metricMatcher.Name = "metric_name"
+		cond, ok := matcherWhere(&metricMatcher)
+		if !ok {
+			if len(names) > 0 {
+				return "", nil, fmt.Errorf("%d metrics match __name__, at most %d are allowed", len(names), maxMetricNames)
+			}
+			return "", nil, ErrNoMatchedMetrics
+		}
+		if cond != "" {
+			conds = append(conds, cond)
+		}
 		switch m.Type {
-		case prompb.LabelMatcher_RE:
-			//search += fmt.Sprintf("| regex " + m.Name + "=" + strconv.Quote(m.Value))
-			search += fmt.Sprintf("| regex %s=%q", m.Name, m.Value)
-		case prompb.LabelMatcher_NRE:
-			search += fmt.Sprintf("| regex %s!=%q", m.Name, m.Value)
 		case prompb.LabelMatcher_EQ:
-			search += fmt.Sprintf("| where %s=%q", m.Name, m.Value)
-		case prompb.LabelMatcher_NEQ:
-			search += fmt.Sprintf("| where %s!=%q", m.Name, m.Value)
+			patterns = append(patterns, m.Value)
+		case prompb.LabelMatcher_RE:
+			ps, _, _ := regexToPatterns(m.Value)
+			patterns = append(patterns, ps...)
 		}
 	}
-	search += "| rename metric_name as " + CommonMetricName
-	return search, nil
+	if len(conds) == 0 {
+		conds = append(conds, "metric_name=*")
+	}
+	if len(patterns) == 0 {
+		patterns = append(patterns, "*")
+	}
+	return strings.Join(conds, " AND "), metricsLabels(ctx, c, patterns), nil
+}
+
+// valueMatcher returns a function testing values against m with prometheus semantics.
+func valueMatcher(m *prompb.LabelMatcher) (func(string) bool, error) {
+	switch m.Type {
+	case prompb.LabelMatcher_NEQ:
+		return func(v string) bool { return v != m.Value }, nil
+	case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		positive := m.Type == prompb.LabelMatcher_RE
+		return func(v string) bool { return re.MatchString(v) == positive }, nil
+	}
+	return func(v string) bool { return v == m.Value }, nil
+}
+
+// dimensionPatterns returns the metric_name patterns whose dimensions are looked up for the names
+// selected by matchers. The wildcards of a regex cover all its names with fewer catalog requests,
+// they are only used with a literal prefix which keeps the dimensions of other metrics out.
+func dimensionPatterns(matchers []*prompb.LabelMatcher, names []string) []string {
+	for _, m := range matchers {
+		if m.Type != prompb.LabelMatcher_RE {
+			continue
+		}
+		patterns, _, ok := regexToPatterns(m.Value)
+		if !ok || len(patterns) == 0 || len(patterns) >= len(names) {
+			continue
+		}
+		prefixed := true
+		for _, p := range patterns {
+			prefixed = prefixed && !strings.HasPrefix(p, "*")
+		}
+		if prefixed {
+			return patterns
+		}
+	}
+	return names
+}
+
+// metricsLabels returns the union of the dimensions of metrics, which are looked up concurrently.
+// No lookup is started once ctx is done.
+func metricsLabels(ctx context.Context, c RemoteClient, metrics []string) []string {
+	results := make([][]string, len(metrics))
+	sem := make(chan struct{}, catalogConcurrency)
+	var wg sync.WaitGroup
+dispatch:
+	for i, metric := range metrics {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		wg.Add(1)
+		go func(i int, metric string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = c.MetricLabels(ctx, metric)
+		}(i, metric)
+	}
+	wg.Wait()
+	labels := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, metricLabels := range results {
+		for _, l := range metricLabels {
+			if !seen[l] {
+				seen[l] = true
+				labels = append(labels, l)
+			}
+		}
+	}
+	return labels
+}
+
+// matcherWhere renders m as a condition of the mstats where clause, so that splunk filters
+// the series before aggregating them. ok is false when m can not be expressed there.
+// The name of m must be validated by splField before.
+// As in prometheus, an empty value stands for a missing label.
+// Values are only excluded after mstats, as splunk compares them case-insensitively in the
+// where clause and would also drop the series whose values differ in case.
+func matcherWhere(m *prompb.LabelMatcher) (cond string, ok bool) {
+	switch m.Type {
+	case prompb.LabelMatcher_EQ, prompb.LabelMatcher_NEQ:
+		if strings.Contains(m.Value, "*") || m.Type == prompb.LabelMatcher_NEQ && m.Value != "" {
+			return "", false
+		}
+		cond = m.Name + "=" + splQuote(m.Value)
+		if m.Value == "" {
+			cond = m.Name + "=*"
+		}
+		if (m.Type == prompb.LabelMatcher_EQ) == (m.Value == "") {
+			cond = "NOT " + cond
+		}
+		return cond, true
+	case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+		patterns, matchEmpty, ok := regexToPatterns(m.Value)
+		if !ok {
+			return "", false
+		}
+		positive := m.Type == prompb.LabelMatcher_RE
+		switch {
+		case len(patterns) == 0:
+			// only the empty value matches
+			cond = m.Name + "=*"
+			positive = !positive
+		case matchEmpty && len(patterns) == 1 && patterns[0] == "*":
+			// matches everything
+			if positive {
+				return "", true
+			}
+			return "", false
+		case matchEmpty || !positive:
+			return "", false
+		case len(patterns) == 1:
+			cond = m.Name + "=" + splQuote(patterns[0])
+		default:
+			quoted := make([]string, 0, len(patterns))
+			for _, p := range patterns {
+				quoted = append(quoted, splQuote(p))
+			}
+			cond = fmt.Sprintf("%s IN (%s)", m.Name, strings.Join(quoted, ", "))
+		}
+		if !positive {
+			cond = "NOT " + cond
+		}
+		return cond, true
+	}
+	return "", false
+}
+
+// caseSensitivePipe checks the values of a positive matcher rendered by matcherWhere again
+// after mstats, as splunk compares field values in the where clause case-insensitively.
+func caseSensitivePipe(m *prompb.LabelMatcher) string {
+	field := splEvalField(m.Name)
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		if m.Value == "" {
+			return ""
+		}
+		return fmt.Sprintf("| where %s=%s", field, splQuote(m.Value))
+	case prompb.LabelMatcher_RE:
+		patterns, _, _ := regexToPatterns(m.Value)
+		if len(patterns) == 0 || len(patterns) == 1 && patterns[0] == "*" {
+			return ""
+		}
+		return fmt.Sprintf("| where match(%s, %s)", field, splQuote("^(?:"+m.Value+")$"))
+	}
+	return ""
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matcherPipe renders m as a filter command applied to the mstats results.
+// Negative matchers keep the series without the label unless the empty value is excluded too.
+func matcherPipe(m *prompb.LabelMatcher) string {
+	field := splEvalField(m.Name)
+	re := "^(?:" + m.Value + ")$"
+	switch m.Type {
+	case prompb.LabelMatcher_RE:
+		return fmt.Sprintf("| regex %s=%s", m.Name, splQuote(re))
+	case prompb.LabelMatcher_NRE:
+		compiled, err := regexp.Compile(re)
+		if err != nil {
+			return fmt.Sprintf("| regex %s!=%s", m.Name, splQuote(re))
+		}
+		// match of a missing field is null, which where treats as false.
+		if compiled.MatchString("") {
+			return fmt.Sprintf("| where NOT match(%s, %s)", field, splQuote(re))
+		}
+		return fmt.Sprintf("| where isnull(%s) OR NOT match(%s, %s)", field, field, splQuote(re))
+	case prompb.LabelMatcher_EQ:
+		return fmt.Sprintf("| where %s=%s", field, splQuote(m.Value))
+	case prompb.LabelMatcher_NEQ:
+		return fmt.Sprintf("| where isnull(%s) OR %s!=%s", field, field, splQuote(m.Value))
+	}
+	return ""
 }
 
 type SplunkMetricEvent struct {
 	Time      int64
 	MetricStr string
+	// Fields is set for native metric events, it holds metric_name, _value and the dimensions.
+	Fields map[string]interface{} `json:",omitempty"`
 }
 
 func TimeSeriesToPromMetrics(series prompb.TimeSeries) []SplunkMetricEvent {
@@ -78,3 +458,92 @@ func TimeSeriesToPromMetrics(series prompb.TimeSeries) []SplunkMetricEvent {
 	}
 	return res
 }
+
+// TimeSeriesToMetricEvents converts series to native splunk metric events,
+// which need no transforms on the splunk side. Non finite samples (e.g. stale markers)
+// can not be stored in a metric index and are skipped.
+func TimeSeriesToMetricEvents(series prompb.TimeSeries) []SplunkMetricEvent {
+	res := make([]SplunkMetricEvent, 0, len(series.Samples))
+	dims := make(map[string]interface{}, len(series.Labels))
+	metricName := ""
+	for _, label := range series.Labels {
+		if label.Name == "__name__" {
+			metricName = label.Value
+			continue
+		}
+		dims[label.Name] = label.Value
+	}
+	if metricName == "" {
+		return nil
+	}
+	for _, sample := range series.Samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		fields := make(map[string]interface{}, len(dims)+2)
+		for k, v := range dims {
+			fields[k] = v
+		}
+		fields["metric_name"] = metricName
+		fields["_value"] = sample.Value
+		res = append(res, SplunkMetricEvent{
+			Time:   sample.Timestamp,
+			Fields: fields,
+		})
+	}
+	return res
+}
+
+// TimeSeriesToMultiMetricEvents groups samples of all series by their labels except __name__
+// and timestamp, every group becomes one multiple-measurement metric event
+// with a `metric_name:<name>` field per metric. Events keep the order in which groups first appear.
+func TimeSeriesToMultiMetricEvents(series []prompb.TimeSeries) []SplunkMetricEvent {
+	res := make([]SplunkMetricEvent, 0)
+	groups := make(map[string]int)
+	for _, s := range series {
+		labels := make([]prompb.Label, 0, len(s.Labels))
+		metricName := ""
+		for _, label := range s.Labels {
+			if label.Name == "__name__" {
+				metricName = label.Value
+				continue
+			}
+			labels = append(labels, label)
+		}
+		if metricName == "" {
+			continue
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].Name < labels[j].Name
+		})
+		var key strings.Builder
+		for _, label := range labels {
+			key.WriteString(label.Name)
+			key.WriteByte(0xff)
+			key.WriteString(label.Value)
+			key.WriteByte(0xff)
+		}
+		labelsKey := key.String()
+		for _, sample := range s.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				continue
+			}
+			groupKey := labelsKey + strconv.FormatInt(sample.Timestamp, 10)
+			i, ok := groups[groupKey]
+			if !ok {
+				fields := make(map[string]interface{}, len(labels)+1)
+				for _, label := range labels {
+					fields[label.Name] = label.Value
+				}
+				i = len(res)
+				groups[groupKey] = i
+				res = append(res, SplunkMetricEvent{
+					Time:   sample.Timestamp,
+					Fields: fields,
+				})
+			}
+			res[i].Fields["metric_name:"+metricName] = sample.Value
+		}
+	}
+	return res
+}
@@ -1,21 +1,36 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/kebe7jun/ropee/test"
 	"github.com/prometheus/prometheus/prompb"
 )
 
 type rClient struct {
 	RemoteClient
-	labels []string
+	labels  []string
+	metrics []string
 }
 
-func (c *rClient) MetricLabels(string) []string {
+func (c *rClient) MetricLabels(context.Context, string) []string {
 	return c.labels
 }
 
+func (c *rClient) LabelValues(context.Context, string) []string {
+	return c.metrics
+}
+
 func TestMakeSPL(t *testing.T) {
 	cases := []struct {
 		name     string
@@ -129,7 +144,155 @@ func TestMakeSPL(t *testing.T) {
 				labels: []string{"test1", "test2", "test3"},
 			},
 			"test",
-			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test span=10s by metric_name test1 test2 test3| where test1!="test"| regex test2=".*test$"| regex test3!=".*test$"| rename metric_name as ropee_metric_name`,
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test AND test2="*test" span=10s by metric_name test1 test2 test3| where isnull('test1') OR 'test1'!="test"| where match('test2', "^(?:.*test$)$")| where isnull('test3') OR NOT match('test3', "^(?:.*test$)$")| rename metric_name as ropee_metric_name`,
+			nil,
+		},
+		{
+			"regex pushdown",
+			prompb.Query{
+				StartTimestampMs: 0,
+				EndTimestampMs:   10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: "test",
+					},
+					{
+						Type:  prompb.LabelMatcher_RE,
+						Name:  "a",
+						Value: "foo|bar",
+					},
+					{
+						Type:  prompb.LabelMatcher_RE,
+						Name:  "b",
+						Value: ".*",
+					},
+					{
+						Type:  prompb.LabelMatcher_RE,
+						Name:  "c",
+						Value: ".+",
+					},
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "d",
+						Value: "",
+					},
+					{
+						Type:  prompb.LabelMatcher_NRE,
+						Name:  "e",
+						Value: "node-[12]",
+					},
+				},
+				Hints: &prompb.ReadHints{
+					StepMs: 0,
+				},
+			},
+			rClient{
+				labels: []string{"a"},
+			},
+			"test",
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test AND a IN ("foo", "bar") AND c="*" AND NOT d=* span=10s by metric_name a| where match('a', "^(?:foo|bar)$")| where isnull('e') OR NOT match('e', "^(?:node-[12])$")| rename metric_name as ropee_metric_name`,
+			nil,
+		},
+		{
+			"case sensitive values",
+			prompb.Query{
+				StartTimestampMs: 0,
+				EndTimestampMs:   10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: "test",
+					},
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "job",
+						Value: "API",
+					},
+					{
+						Type:  prompb.LabelMatcher_RE,
+						Name:  "env",
+						Value: "Prod|Dev",
+					},
+				},
+				Hints: &prompb.ReadHints{
+					StepMs: 0,
+				},
+			},
+			rClient{
+				labels: []string{"instance"},
+			},
+			"test",
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test AND job="API" AND env IN ("Prod", "Dev") span=10s by metric_name instance job env| where 'job'="API"| where match('env', "^(?:Prod|Dev)$")| rename metric_name as ropee_metric_name`,
+			nil,
+		},
+		{
+			"case sensitive exclusion",
+			prompb.Query{
+				StartTimestampMs: 0,
+				EndTimestampMs:   10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: "test",
+					},
+					{
+						Type:  prompb.LabelMatcher_NEQ,
+						Name:  "job",
+						Value: "api",
+					},
+					{
+						Type:  prompb.LabelMatcher_NRE,
+						Name:  "env",
+						Value: "prod|dev",
+					},
+				},
+				Hints: &prompb.ReadHints{
+					StepMs: 0,
+				},
+			},
+			rClient{
+				labels: []string{"job", "env"},
+			},
+			"test",
+			// job="API" and env="Prod" series are not dropped by mstats and kept by the pipes.
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test span=10s by metric_name job env| where isnull('job') OR 'job'!="api"| where isnull('env') OR NOT match('env', "^(?:prod|dev)$")| rename metric_name as ropee_metric_name`,
+			nil,
+		},
+		{
+			"regex fallback",
+			prompb.Query{
+				StartTimestampMs: 0,
+				EndTimestampMs:   10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: "test",
+					},
+					{
+						Type:  prompb.LabelMatcher_RE,
+						Name:  "a",
+						Value: "[0-9]+",
+					},
+					{
+						Type:  prompb.LabelMatcher_NRE,
+						Name:  "b",
+						Value: "foo|",
+					},
+				},
+				Hints: &prompb.ReadHints{
+					StepMs: 0,
+				},
+			},
+			rClient{
+				labels: []string{"a"},
+			},
+			"test",
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test span=10s by metric_name a| regex a="^(?:[0-9]+)$"| where NOT match('b', "^(?:foo|)$")| rename metric_name as ropee_metric_name`,
 			nil,
 		},
 		{
@@ -156,7 +319,7 @@ func TestMakeSPL(t *testing.T) {
 			fmt.Errorf("__name__ is required"),
 		},
 		{
-			"__name__ not eq",
+			"__name__ nothing matched",
 			prompb.Query{
 				StartTimestampMs: 0,
 				EndTimestampMs:   10,
@@ -172,16 +335,69 @@ func TestMakeSPL(t *testing.T) {
 				},
 			},
 			rClient{
-				labels: []string{"test"},
+				labels:  []string{"test"},
+				metrics: []string{"test"},
 			},
 			"test",
 			"",
-			fmt.Errorf("metric_name label macher type error, only euqals supported"),
+			ErrNoMatchedMetrics,
+		},
+		{
+			"__name__ regex from catalog",
+			prompb.Query{
+				StartTimestampMs: 0,
+				EndTimestampMs:   10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_RE,
+						Name:  "__name__",
+						Value: "node_cpu.*",
+					},
+					{
+						Type:  prompb.LabelMatcher_NEQ,
+						Name:  "__name__",
+						Value: "node_cpu_guest",
+					},
+				},
+				Hints: &prompb.ReadHints{
+					StepMs: 0,
+				},
+			},
+			rClient{
+				labels:  []string{"cpu"},
+				metrics: []string{"node_load1", "node_cpu_seconds", "node_cpu_guest", "node_cpu"},
+			},
+			"test",
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name IN ("node_cpu", "node_cpu_seconds") span=10s by metric_name cpu| rename metric_name as ropee_metric_name`,
+			nil,
+		},
+		{
+			"__name__ regex wildcard",
+			prompb.Query{
+				StartTimestampMs: 0,
+				EndTimestampMs:   10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_RE,
+						Name:  "__name__",
+						Value: "node_cpu.*",
+					},
+				},
+				Hints: &prompb.ReadHints{
+					StepMs: 0,
+				},
+			},
+			rClient{
+				labels: []string{"cpu"},
+			},
+			"test",
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name="node_cpu*" span=10s by metric_name cpu| rename metric_name as ropee_metric_name`,
+			nil,
 		},
 	}
 	for i, c := range cases {
 		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
-			res, err := MakeSPL(&c.q, &c.cli, c.index)
+			res, err := MakeSPL(context.Background(), &c.q, &c.cli, c.index, ReadOptions{})
 			if res != c.wannaRes || (err != nil && err.Error() != c.wannaErr.Error()) {
 				t.Fatalf("res: %s, %v, want: %s, %v", res, err, c.wannaRes, c.wannaErr)
 			}
@@ -189,6 +405,259 @@ func TestMakeSPL(t *testing.T) {
 	}
 }
 
+func TestMakeSPLDimensionLookups(t *testing.T) {
+	metrics := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, fmt.Sprintf(`{"name":"node_cpu_%d_seconds"}`, i))
+	}
+	cases := []struct {
+		name         string
+		regex        string
+		wannaLookups int
+		wannaFirst   string
+	}{
+		{
+			"prefix wildcard",
+			"node_cpu_.*",
+			1,
+			"node_cpu_*",
+		},
+		{
+			"per metric",
+			".*_seconds",
+			20,
+			"node_cpu_0_seconds",
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			var mtx sync.Mutex
+			lookups := make([]string, 0)
+			fc := &routeClient{routes: []route{
+				{"GET", "/catalog/metricstore/metrics", reply(200, `{"entry":[`+strings.Join(metrics, ",")+`]}`)},
+				{"GET", "/catalog/metricstore/dimensions", func(req *http.Request) (int, string) {
+					mtx.Lock()
+					lookups = append(lookups, req.URL.Query().Get("metric_name"))
+					mtx.Unlock()
+					return 200, `{"entry":[{"name":"cpu"}]}`
+				}},
+			}}
+			client := &Client{
+				url:     "http://test.com",
+				client:  fc,
+				index:   "test",
+				timeout: time.Second,
+				log:     test.Logger(),
+			}
+			q := &prompb.Query{
+				EndTimestampMs: 10,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_RE,
+						Name:  "__name__",
+						Value: c.regex,
+					},
+				},
+				Hints: &prompb.ReadHints{},
+			}
+			res, err := MakeSPL(context.Background(), q, client, "test", ReadOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(res, "span=10s by metric_name cpu|") {
+				t.Fatalf("unexpected dimensions: %s", res)
+			}
+			sort.Strings(lookups)
+			if len(lookups) != c.wannaLookups || lookups[0] != c.wannaFirst {
+				t.Fatalf("unexpected lookups: %v, want: %d of %s", lookups, c.wannaLookups, c.wannaFirst)
+			}
+		})
+	}
+}
+
+func TestMakeSPLAggregation(t *testing.T) {
+	opts := ReadOptions{
+		DefaultAggregation: AggregationAvg,
+		MetricAggregations: []MetricAggregation{
+			{Pattern: "*_total", Aggregation: AggregationLatest},
+		},
+		RawMaxRangeMs: 3600 * 1000,
+	}
+	cases := []struct {
+		name     string
+		metric   string
+		hints    *prompb.ReadHints
+		endMs    int64
+		opts     ReadOptions
+		wannaRes string
+	}{
+		{
+			"no options",
+			"test",
+			&prompb.ReadHints{StepMs: 60000},
+			24 * 3600 * 1000,
+			ReadOptions{},
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test span=60s by metric_name | rename metric_name as ropee_metric_name`,
+		},
+		{
+			"default aggregation",
+			"test",
+			&prompb.ReadHints{StepMs: 60000},
+			24 * 3600 * 1000,
+			opts,
+			`| mstats avg(_value) as ropee_metric_value where index=test AND metric_name=test span=60s by metric_name | rename metric_name as ropee_metric_name`,
+		},
+		{
+			"metric aggregation",
+			"http_requests_total",
+			&prompb.ReadHints{StepMs: 60000},
+			24 * 3600 * 1000,
+			opts,
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=http_requests_total span=60s by metric_name | rename metric_name as ropee_metric_name`,
+		},
+		{
+			"hints func",
+			"http_requests_total",
+			&prompb.ReadHints{StepMs: 60000, Func: "max_over_time"},
+			24 * 3600 * 1000,
+			opts,
+			`| mstats max(_value) as ropee_metric_value where index=test AND metric_name=http_requests_total span=60s by metric_name | rename metric_name as ropee_metric_name`,
+		},
+		{
+			"raw samples",
+			"test",
+			&prompb.ReadHints{StepMs: 60000},
+			3600 * 1000,
+			opts,
+			`| mstats avg(_value) as ropee_metric_value where index=test AND metric_name=test span=1s by metric_name | rename metric_name as ropee_metric_name`,
+		},
+		{
+			"nil hints",
+			"test",
+			nil,
+			24 * 3600 * 1000,
+			ReadOptions{},
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test span=10s by metric_name | rename metric_name as ropee_metric_name`,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			q := prompb.Query{
+				StartTimestampMs: 0,
+				EndTimestampMs:   c.endMs,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: c.metric,
+					},
+				},
+				Hints: c.hints,
+			}
+			res, err := MakeSPL(context.Background(), &q, &rClient{}, "test", c.opts)
+			if err != nil || res != c.wannaRes {
+				t.Fatalf("res: %s, %v, want: %s", res, err, c.wannaRes)
+			}
+		})
+	}
+}
+
+func encodeHintsExt(grouping []string, by bool, rangeMs int64) []byte {
+	b := proto.NewBuffer(nil)
+	for _, g := range grouping {
+		b.EncodeVarint(hintsGroupingField<<3 | proto.WireBytes)
+		b.EncodeStringBytes(g)
+	}
+	if by {
+		b.EncodeVarint(hintsByField<<3 | proto.WireVarint)
+		b.EncodeVarint(1)
+	}
+	if rangeMs > 0 {
+		b.EncodeVarint(hintsRangeMsField<<3 | proto.WireVarint)
+		b.EncodeVarint(uint64(rangeMs))
+	}
+	return b.Bytes()
+}
+
+func TestMakeSPLPushdown(t *testing.T) {
+	cases := []struct {
+		name     string
+		metric   string
+		hints    prompb.ReadHints
+		wannaRes string
+	}{
+		{
+			"sum by",
+			"test",
+			prompb.ReadHints{StepMs: 60000, Func: "sum", XXX_unrecognized: encodeHintsExt([]string{"job"}, true, 0)},
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test span=60s by metric_name instance job| fillnull value="" job| stats sum(ropee_metric_value) as ropee_metric_value by _time metric_name job| rename metric_name as ropee_metric_name`,
+		},
+		{
+			"max without",
+			"test",
+			prompb.ReadHints{StepMs: 60000, Func: "max", XXX_unrecognized: encodeHintsExt([]string{"instance"}, false, 0)},
+			`| mstats max(_value) as ropee_metric_value where index=test AND metric_name=test span=60s by metric_name instance job| fillnull value="" job| stats max(ropee_metric_value) as ropee_metric_value by _time metric_name job| rename metric_name as ropee_metric_name`,
+		},
+		{
+			"sum all",
+			"test",
+			prompb.ReadHints{StepMs: 60000, Func: "sum", XXX_unrecognized: encodeHintsExt(nil, true, 0)},
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test span=60s by metric_name instance job| stats sum(ropee_metric_value) as ropee_metric_value by _time metric_name | rename metric_name as ropee_metric_name`,
+		},
+		{
+			"count is not pushed down",
+			"test",
+			prompb.ReadHints{StepMs: 60000, Func: "count", XXX_unrecognized: encodeHintsExt(nil, true, 0)},
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test span=60s by metric_name instance job| rename metric_name as ropee_metric_name`,
+		},
+		{
+			"rate range limits span",
+			"test",
+			prompb.ReadHints{StepMs: 3600000, Func: "rate", XXX_unrecognized: encodeHintsExt(nil, false, 300000)},
+			`| mstats latest(_value) as ropee_metric_value where index=test AND metric_name=test span=150s by metric_name instance job| rename metric_name as ropee_metric_name`,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			q := prompb.Query{
+				StartTimestampMs: 0,
+				EndTimestampMs:   24 * 3600 * 1000,
+				Matchers: []*prompb.LabelMatcher{
+					{
+						Type:  prompb.LabelMatcher_EQ,
+						Name:  "__name__",
+						Value: c.metric,
+					},
+				},
+				Hints: &c.hints,
+			}
+			res, err := MakeSPL(context.Background(), &q, &rClient{labels: []string{"instance", "job"}}, "test", ReadOptions{PushdownGrouping: true})
+			if err != nil || res != c.wannaRes {
+				t.Fatalf("res: %s, %v, want: %s", res, err, c.wannaRes)
+			}
+		})
+	}
+}
+
+func TestParseMetricAggregations(t *testing.T) {
+	res, err := ParseMetricAggregations("node_*=avg, *_total=latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MetricAggregation{
+		{Pattern: "node_*", Aggregation: AggregationAvg},
+		{Pattern: "*_total", Aggregation: AggregationLatest},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("unexpected res: %v, want: %v", res, want)
+	}
+	for _, s := range []string{"node_*", "node_*=median", "[=avg"} {
+		if _, err := ParseMetricAggregations(s); err == nil {
+			t.Fatalf("expect error for %q", s)
+		}
+	}
+}
+
 func TestTimeSeriesToPromMetrics(t *testing.T) {
 	cases := []struct {
 		name string
@@ -310,3 +779,122 @@ func TestTimeSeriesToPromMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestTimeSeriesToMultiMetricEvents(t *testing.T) {
+	cases := []struct {
+		name   string
+		series []prompb.TimeSeries
+		want   []SplunkMetricEvent
+	}{
+		{
+			"group same labels",
+			[]prompb.TimeSeries{
+				{
+					Labels: []prompb.Label{
+						{Name: "__name__", Value: "foo"},
+						{Name: "instance", Value: "a"},
+					},
+					Samples: []prompb.Sample{
+						{Value: 1, Timestamp: 1},
+						{Value: 2, Timestamp: 2},
+					},
+				},
+				{
+					Labels: []prompb.Label{
+						{Name: "instance", Value: "a"},
+						{Name: "__name__", Value: "bar"},
+					},
+					Samples: []prompb.Sample{
+						{Value: 3, Timestamp: 1},
+					},
+				},
+			},
+			[]SplunkMetricEvent{
+				{
+					Time: 1,
+					Fields: map[string]interface{}{
+						"instance":        "a",
+						"metric_name:foo": float64(1),
+						"metric_name:bar": float64(3),
+					},
+				},
+				{
+					Time: 2,
+					Fields: map[string]interface{}{
+						"instance":        "a",
+						"metric_name:foo": float64(2),
+					},
+				},
+			},
+		},
+		{
+			"different labels",
+			[]prompb.TimeSeries{
+				{
+					Labels: []prompb.Label{
+						{Name: "__name__", Value: "foo"},
+						{Name: "instance", Value: "a"},
+					},
+					Samples: []prompb.Sample{
+						{Value: 1, Timestamp: 1},
+					},
+				},
+				{
+					Labels: []prompb.Label{
+						{Name: "__name__", Value: "foo"},
+						{Name: "instance", Value: "b"},
+					},
+					Samples: []prompb.Sample{
+						{Value: 2, Timestamp: 1},
+					},
+				},
+			},
+			[]SplunkMetricEvent{
+				{
+					Time: 1,
+					Fields: map[string]interface{}{
+						"instance":        "a",
+						"metric_name:foo": float64(1),
+					},
+				},
+				{
+					Time: 1,
+					Fields: map[string]interface{}{
+						"instance":        "b",
+						"metric_name:foo": float64(2),
+					},
+				},
+			},
+		},
+		{
+			"missing __name__ and stale marker",
+			[]prompb.TimeSeries{
+				{
+					Labels: []prompb.Label{
+						{Name: "instance", Value: "a"},
+					},
+					Samples: []prompb.Sample{
+						{Value: 1, Timestamp: 1},
+					},
+				},
+				{
+					Labels: []prompb.Label{
+						{Name: "__name__", Value: "foo"},
+					},
+					Samples: []prompb.Sample{
+						{Value: math.NaN(), Timestamp: 1},
+					},
+				},
+			},
+			[]SplunkMetricEvent{},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			res := TimeSeriesToMultiMetricEvents(c.series)
+			if !reflect.DeepEqual(res, c.want) {
+				t.Fatalf("unexpect res: %v, want: %v", res, c.want)
+			}
+		})
+	}
+}
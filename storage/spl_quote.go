@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Everything from a prometheus query which ends up in SPL has to go through these
+// helpers, so that a crafted matcher can not leave its clause and inject search commands.
+var (
+	fieldNameRe  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+	metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:.]*$`)
+	indexNameRe  = regexp.MustCompile(`^[a-zA-Z0-9_*][a-zA-Z0-9_*-]*$`)
+)
+
+var splQuoteReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// splQuote renders value as a double quoted SPL string.
+// Note that `*` is still a wildcard inside quotes in search and mstats where clauses.
+func splQuote(value string) string {
+	return `"` + splQuoteReplacer.Replace(value) + `"`
+}
+
+// splField validates a label name used as SPL field name.
+func splField(name string) (string, error) {
+	if !fieldNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid label name %q", name)
+	}
+	return name, nil
+}
+
+// splEvalField renders a field name for eval expressions, e.g. the where command.
+func splEvalField(name string) string {
+	return "'" + name + "'"
+}
+
+// splMetricName validates a metric name used unquoted in SPL.
+func splMetricName(name string) (string, error) {
+	if !metricNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid metric name %q", name)
+	}
+	return name, nil
+}
+
+// splIndex validates an index name, wildcards are allowed.
+func splIndex(index string) (string, error) {
+	if !indexNameRe.MatchString(index) {
+		return "", fmt.Errorf("invalid index name %q", index)
+	}
+	return index, nil
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const hostileAlphabet = "ab_.*|[]\"\\'`=() \n$^+?{}:-,"
+
+func randomString(r *rand.Rand, alphabet string, maxLen int) string {
+	n := r.Intn(maxLen + 1)
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+// splOutsideQuotes returns spl with the content of double quoted strings removed,
+// ok is false when a string is not terminated.
+func splOutsideQuotes(spl string) (string, bool) {
+	var out strings.Builder
+	inQuote := false
+	for i := 0; i < len(spl); i++ {
+		ch := spl[i]
+		if inQuote {
+			if ch == '\\' {
+				i++
+				continue
+			}
+			if ch == '"' {
+				inQuote = false
+				out.WriteByte(ch)
+			}
+			continue
+		}
+		if ch == '"' {
+			inQuote = true
+		}
+		out.WriteByte(ch)
+	}
+	return out.String(), !inQuote
+}
+
+func splUnquote(quoted string) string {
+	var out strings.Builder
+	for i := 1; i < len(quoted)-1; i++ {
+		if quoted[i] == '\\' {
+			i++
+		}
+		out.WriteByte(quoted[i])
+	}
+	return out.String()
+}
+
+func TestSplQuote(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		v := randomString(r, hostileAlphabet, 20)
+		quoted := splQuote(v)
+		if outside, ok := splOutsideQuotes(quoted); !ok || outside != `""` {
+			t.Fatalf("value %q breaks out of quotes: %s", v, quoted)
+		}
+		if splUnquote(quoted) != v {
+			t.Fatalf("unexpected unquote of %s: %q, want: %q", quoted, splUnquote(quoted), v)
+		}
+	}
+}
+
+func TestMakeSPLInjection(t *testing.T) {
+	allowedCommands := []string{" mstats ", " regex ", " where ", " rename "}
+	types := []prompb.LabelMatcher_Type{
+		prompb.LabelMatcher_EQ,
+		prompb.LabelMatcher_NEQ,
+		prompb.LabelMatcher_RE,
+		prompb.LabelMatcher_NRE,
+	}
+	r := rand.New(rand.NewSource(1))
+	cli := &rClient{
+		labels:  []string{"instance", "bad| delete", "job"},
+		metrics: []string{"up", "node_load1", "x\" | delete", "up*"},
+	}
+	for i := 0; i < 5000; i++ {
+		q := prompb.Query{
+			Matchers: []*prompb.LabelMatcher{
+				{
+					Type:  types[r.Intn(len(types))],
+					Name:  "__name__",
+					Value: randomString(r, hostileAlphabet, 10),
+				},
+			},
+			Hints: &prompb.ReadHints{},
+		}
+		for j := r.Intn(4); j > 0; j-- {
+			name := "job"
+			if r.Intn(3) == 0 {
+				name = randomString(r, hostileAlphabet, 6)
+			}
+			q.Matchers = append(q.Matchers, &prompb.LabelMatcher{
+				Type:  types[r.Intn(len(types))],
+				Name:  name,
+				Value: randomString(r, hostileAlphabet, 10),
+			})
+		}
+		t.Run(fmt.Sprintf("test-%d", i), func(t *testing.T) {
+			spl, err := MakeSPL(context.Background(), &q, cli, "main", ReadOptions{})
+			if err != nil {
+				return
+			}
+			for _, m := range q.Matchers[1:] {
+				if !fieldNameRe.MatchString(m.Name) {
+					t.Fatalf("invalid label name %q accepted: %s", m.Name, spl)
+				}
+			}
+			outside, ok := splOutsideQuotes(spl)
+			if !ok {
+				t.Fatalf("unterminated string: %s", spl)
+			}
+			if strings.ContainsAny(outside, "[]`\n") {
+				t.Fatalf("unexpected subsearch or macro: %s", spl)
+			}
+			for _, cmd := range strings.Split(outside, "|")[1:] {
+				allowed := false
+				for _, a := range allowedCommands {
+					allowed = allowed || strings.HasPrefix(cmd, a)
+				}
+				if !allowed {
+					t.Fatalf("unexpected command %q in %s", cmd, spl)
+				}
+			}
+		})
+	}
+}
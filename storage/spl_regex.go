@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+const (
+	// maxRegexPatterns limits how many IN values a regex may be expanded to.
+	maxRegexPatterns = 32
+	// maxCharClassSize limits the runes of a char class expanded to literals.
+	maxCharClassSize = 16
+)
+
+// regexToPatterns translates a prometheus (fully anchored) regex to splunk search patterns,
+// i.e. literals and `*` wildcards, which match the same non-empty values. ok is false
+// when the regex has no such equivalent. matchEmpty reports whether the regex matches
+// the empty value, which in prometheus also selects series without the label.
+func regexToPatterns(re string) (patterns []string, matchEmpty bool, ok bool) {
+	compiled, err := regexp.Compile("^(?:" + re + ")$")
+	if err != nil {
+		return nil, false, false
+	}
+	matchEmpty = compiled.MatchString("")
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return nil, matchEmpty, false
+	}
+	patterns, ok = nodePatterns(parsed.Simplify(), true)
+	if !ok {
+		return nil, matchEmpty, false
+	}
+	res := make([]string, 0, len(patterns))
+	seen := make(map[string]bool, len(patterns))
+	for _, p := range patterns {
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		res = append(res, p)
+	}
+	return res, matchEmpty, true
+}
+
+// nodePatterns returns the patterns matched by re, top is true when re is the whole regex.
+func nodePatterns(re *syntax.Regexp, top bool) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginText, syntax.OpEndText:
+		return []string{""}, true
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		lit := string(re.Rune)
+		if strings.Contains(lit, "*") {
+			return nil, false
+		}
+		return []string{lit}, true
+	case syntax.OpStar:
+		if isAnyChar(re.Sub[0]) {
+			return []string{"*"}, true
+		}
+	case syntax.OpPlus:
+		// `.+` only equals `*` when nothing else has to match around it.
+		if top && isAnyChar(re.Sub[0]) {
+			return []string{"*"}, true
+		}
+	case syntax.OpCapture:
+		return nodePatterns(re.Sub[0], top)
+	case syntax.OpCharClass:
+		return charClassPatterns(re)
+	case syntax.OpQuest:
+		sub, ok := nodePatterns(re.Sub[0], false)
+		if !ok {
+			return nil, false
+		}
+		return append(sub, ""), true
+	case syntax.OpAlternate:
+		res := make([]string, 0, len(re.Sub))
+		for _, s := range re.Sub {
+			sub, ok := nodePatterns(s, top)
+			if !ok {
+				return nil, false
+			}
+			res = append(res, sub...)
+			if len(res) > maxRegexPatterns {
+				return nil, false
+			}
+		}
+		return res, true
+	case syntax.OpConcat:
+		res := []string{""}
+		for _, s := range re.Sub {
+			sub, ok := nodePatterns(s, false)
+			if !ok {
+				return nil, false
+			}
+			if len(res)*len(sub) > maxRegexPatterns {
+				return nil, false
+			}
+			next := make([]string, 0, len(res)*len(sub))
+			for _, prefix := range res {
+				for _, suffix := range sub {
+					next = append(next, joinPatterns(prefix, suffix))
+				}
+			}
+			res = next
+		}
+		return res, true
+	}
+	return nil, false
+}
+
+func isAnyChar(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpAnyChar || re.Op == syntax.OpAnyCharNotNL
+}
+
+func joinPatterns(prefix, suffix string) string {
+	if strings.HasSuffix(prefix, "*") && strings.HasPrefix(suffix, "*") {
+		return prefix + suffix[1:]
+	}
+	return prefix + suffix
+}
+
+func charClassPatterns(re *syntax.Regexp) ([]string, bool) {
+	if re.Flags&syntax.FoldCase != 0 {
+		return nil, false
+	}
+	res := make([]string, 0)
+	for i := 0; i+1 < len(re.Rune); i += 2 {
+		lo, hi := re.Rune[i], re.Rune[i+1]
+		if int(hi-lo)+1+len(res) > maxCharClassSize {
+			return nil, false
+		}
+		for r := lo; r <= hi; r++ {
+			if r == '*' {
+				return nil, false
+			}
+			res = append(res, string(r))
+		}
+	}
+	return res, true
+}
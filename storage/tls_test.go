@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	ca, err := ioutil.TempFile("", "ropee-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	ca.Close()
+
+	cases := []struct {
+		name        string
+		cfg         TLSConfig
+		wannaCfgErr bool
+		wannaReqErr bool
+	}{
+		{
+			"system cas",
+			TLSConfig{},
+			false,
+			true,
+		},
+		{
+			"ca file",
+			TLSConfig{CAFile: ca.Name()},
+			false,
+			false,
+		},
+		{
+			"server name",
+			TLSConfig{CAFile: ca.Name(), ServerName: "example.com"},
+			false,
+			false,
+		},
+		{
+			"wrong server name",
+			TLSConfig{CAFile: ca.Name(), ServerName: "splunk.local"},
+			false,
+			true,
+		},
+		{
+			"insecure",
+			TLSConfig{InsecureSkipVerify: true},
+			false,
+			false,
+		},
+		{
+			"cert without key",
+			TLSConfig{CertFile: ca.Name()},
+			true,
+			false,
+		},
+		{
+			"missing ca file",
+			TLSConfig{CAFile: ca.Name() + ".missing"},
+			true,
+			false,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			client, err := NewHTTPClient(c.cfg)
+			if (err != nil) != c.wannaCfgErr {
+				t.Fatalf("unexpected config err: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			resp, err := client.Get(srv.URL)
+			if (err != nil) != c.wannaReqErr {
+				t.Fatalf("unexpected request err: %v", err)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/metrics"
+)
+
+const (
+	walSegmentSuffix = ".seg"
+	// every record starts with the payload length and its crc32.
+	walHeaderSize = 8
+
+	walRetryMinBackoff = time.Second
+	walRetryMaxBackoff = time.Minute
+	walCheckInterval   = time.Minute
+)
+
+var walCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// WAL persists outbound events on the local disk, so that samples are not lost
+// while splunk is down for longer than prometheus retries a remote write.
+// Every write request is appended as one record, records are replayed to HEC in order
+// by a background goroutine and a segment file is removed once all its records are sent.
+// Delivery is at-least-once, a partly replayed segment is sent again after a restart.
+type WAL struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	maxAge      time.Duration
+	log         log.Logger
+
+	mtx sync.Mutex
+	// segments are ordered by seq, records are appended to the last one while writer is open.
+	segments []*walSegment
+	writer   *os.File
+	// readOffset and readEvents are the replay progress in segments[0].
+	readOffset int64
+	readEvents int
+
+	startOnce sync.Once
+	// send is replaced when the client is reconfigured, it is guarded by mtx.
+	send   func(context.Context, []SplunkMetricEvent) error
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type walSegment struct {
+	seq     int
+	size    int64
+	events  int
+	modTime time.Time
+}
+
+type walRecord struct {
+	seq    int
+	offset int64
+	next   int64
+	events []SplunkMetricEvent
+}
+
+// OpenWAL opens or creates the WAL in dir. Segments are cut at segmentSize bytes,
+// the oldest segments are dropped when the WAL exceeds maxSize bytes or maxAge, 0 means no limit.
+func OpenWAL(dir string, segmentSize, maxSize int64, maxAge time.Duration, log log.Logger) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		log:         log,
+		notify:      make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), walSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(f.Name(), walSegmentSuffix))
+		if err != nil {
+			continue
+		}
+		seg, err := w.loadSegment(seq, f)
+		if err != nil {
+			return nil, err
+		}
+		w.segments = append(w.segments, seg)
+	}
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].seq < w.segments[j].seq
+	})
+	w.mtx.Lock()
+	w.enforceLimits()
+	w.updateMetrics()
+	w.mtx.Unlock()
+	return w, nil
+}
+
+// loadSegment counts the events of an existing segment and truncates a torn last record.
+func (w *WAL) loadSegment(seq int, info os.FileInfo) (*walSegment, error) {
+	f, err := os.Open(w.segmentPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seg := &walSegment{seq: seq, modTime: info.ModTime()}
+	for seg.size < info.Size() {
+		events, n, err := readWALRecord(f, seg.size, info.Size())
+		if err != nil {
+			level.Warn(w.log).Log("type", "wal", "msg", "truncate corrupted segment", "segment", seq, "offset", seg.size, "err", err)
+			if err := os.Truncate(w.segmentPath(seq), seg.size); err != nil {
+				return nil, err
+			}
+			break
+		}
+		seg.size += n
+		seg.events += len(events)
+	}
+	return seg, nil
+}
+
+// readWALRecord reads the record at offset of a segment of size bytes.
+func readWALRecord(f *os.File, offset, size int64) ([]SplunkMetricEvent, int64, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	// the length is not covered by the checksum, a corrupted one must not allocate up to 4GiB.
+	if int64(length) > size-offset-walHeaderSize {
+		return nil, 0, fmt.Errorf("wal record length %d exceeds the segment", length)
+	}
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, offset+walHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, walCastagnoli) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, fmt.Errorf("wal record checksum mismatch")
+	}
+	var events []SplunkMetricEvent
+	if err := json.Unmarshal(payload, &events); err != nil {
+		return nil, 0, err
+	}
+	return events, walHeaderSize + int64(length), nil
+}
+
+func (w *WAL) segmentPath(seq int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d%s", seq, walSegmentSuffix))
+}
+
+// Append persists events, they are sent to HEC by the replay goroutine.
+func (w *WAL) Append(events []SplunkMetricEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:walHeaderSize], crc32.Checksum(payload, walCastagnoli))
+	copy(record[walHeaderSize:], payload)
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.writer == nil || w.segments[len(w.segments)-1].size >= w.segmentSize {
+		if err := w.cut(); err != nil {
+			return err
+		}
+	}
+	seg := w.segments[len(w.segments)-1]
+	if _, err := w.writer.Write(record); err != nil {
+		w.closeBroken(seg)
+		return err
+	}
+	if err := w.writer.Sync(); err != nil {
+		w.closeBroken(seg)
+		return err
+	}
+	seg.size += int64(len(record))
+	seg.events += len(events)
+	seg.modTime = time.Now()
+	w.enforceLimits()
+	w.updateMetrics()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// cut closes the current segment and starts a new one.
+func (w *WAL) cut() error {
+	if w.writer != nil {
+		if err := w.writer.Close(); err != nil {
+			level.Warn(w.log).Log("type", "wal", "msg", "close segment", "err", err)
+		}
+		w.writer = nil
+	}
+	seq := 1
+	if len(w.segments) > 0 {
+		seq = w.segments[len(w.segments)-1].seq + 1
+	}
+	f, err := os.OpenFile(w.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.writer = f
+	w.segments = append(w.segments, &walSegment{seq: seq, modTime: time.Now()})
+	return nil
+}
+
+// closeBroken drops a partly written record, the next Append starts a new segment.
+func (w *WAL) closeBroken(seg *walSegment) {
+	w.writer.Close()
+	w.writer = nil
+	if err := os.Truncate(w.segmentPath(seg.seq), seg.size); err != nil {
+		level.Error(w.log).Log("type", "wal", "msg", "truncate segment", "segment", seg.seq, "err", err)
+	}
+}
+
+// enforceLimits drops the oldest segments exceeding maxSize or maxAge, the segment
+// being written is always kept.
+func (w *WAL) enforceLimits() {
+	for len(w.segments) > 1 {
+		oldest := w.segments[0]
+		tooOld := w.maxAge > 0 && time.Since(oldest.modTime) > w.maxAge
+		tooBig := w.maxSize > 0 && w.size() > w.maxSize
+		if !tooOld && !tooBig {
+			return
+		}
+		dropped := oldest.events - w.readEvents
+		level.Warn(w.log).Log("type", "wal", "msg", "drop segment", "segment", oldest.seq, "events", dropped, "too_old", tooOld, "too_big", tooBig)
+		metrics.WALDroppedEvents.Add(float64(dropped))
+		w.removeOldest()
+	}
+}
+
+func (w *WAL) removeOldest() {
+	if err := os.Remove(w.segmentPath(w.segments[0].seq)); err != nil {
+		level.Error(w.log).Log("type", "wal", "msg", "remove segment", "segment", w.segments[0].seq, "err", err)
+	}
+	w.segments = w.segments[1:]
+	w.readOffset = 0
+	w.readEvents = 0
+}
+
+func (w *WAL) size() int64 {
+	var size int64
+	for _, seg := range w.segments {
+		size += seg.size
+	}
+	return size
+}
+
+func (w *WAL) pending() int {
+	pending := -w.readEvents
+	for _, seg := range w.segments {
+		pending += seg.events
+	}
+	return pending
+}
+
+func (w *WAL) updateMetrics() {
+	metrics.WALSegments.Set(float64(len(w.segments)))
+	metrics.WALSizeBytes.Set(float64(w.size()))
+	metrics.WALPendingEvents.Set(float64(w.pending()))
+}
+
+// next returns the oldest record which is not sent yet, ok is false when the replay is caught up.
+func (w *WAL) next() (rec walRecord, ok bool, err error) {
+	w.mtx.Lock()
+	for len(w.segments) > 0 && w.readOffset >= w.segments[0].size {
+		if len(w.segments) == 1 && w.writer != nil {
+			break
+		}
+		w.removeOldest()
+		w.updateMetrics()
+	}
+	if len(w.segments) == 0 || w.readOffset >= w.segments[0].size {
+		w.mtx.Unlock()
+		return rec, false, nil
+	}
+	rec.seq, rec.offset = w.segments[0].seq, w.readOffset
+	size := w.segments[0].size
+	w.mtx.Unlock()
+
+	f, err := os.Open(w.segmentPath(rec.seq))
+	if err != nil {
+		return rec, false, err
+	}
+	defer f.Close()
+	events, n, err := readWALRecord(f, rec.offset, size)
+	if err != nil {
+		return rec, false, err
+	}
+	rec.next = rec.offset + n
+	rec.events = events
+	return rec, true, nil
+}
+
+// commit marks rec as sent, it is ignored if the segment was dropped meanwhile.
+func (w *WAL) commit(rec walRecord) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if len(w.segments) == 0 || w.segments[0].seq != rec.seq || w.readOffset != rec.offset {
+		return
+	}
+	w.readOffset = rec.next
+	w.readEvents += len(rec.events)
+	w.updateMetrics()
+}
+
+// skipSegment gives up the rest of a segment which can not be read.
+func (w *WAL) skipSegment(seq int) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if len(w.segments) == 0 || w.segments[0].seq != seq {
+		return
+	}
+	seg := w.segments[0]
+	metrics.WALDroppedEvents.Add(float64(seg.events - w.readEvents))
+	w.readOffset = seg.size
+	w.readEvents = seg.events
+	w.updateMetrics()
+}
+
+// start replays the buffer with send, later calls only replace send.
+// The context passed to send is cancelled by Close.
+func (w *WAL) start(send func(context.Context, []SplunkMetricEvent) error) {
+	w.mtx.Lock()
+	w.send = send
+	w.mtx.Unlock()
+	w.startOnce.Do(func() {
+		go w.run()
+	})
+}
+
+func (w *WAL) sender() func(context.Context, []SplunkMetricEvent) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.send
+}
+
+func (w *WAL) run() {
+	defer close(w.done)
+	// ctx aborts a send blocked on HEC, so that Close does not wait for its retries.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ticker := time.NewTicker(walCheckInterval)
+	defer ticker.Stop()
+	for {
+		rec, ok, err := w.next()
+		if err != nil {
+			level.Error(w.log).Log("type", "wal", "msg", "read segment", "segment", rec.seq, "offset", rec.offset, "err", err)
+			w.skipSegment(rec.seq)
+			continue
+		}
+		if !ok {
+			select {
+			case <-w.stop:
+				return
+			case <-w.notify:
+			case <-ticker.C:
+				w.mtx.Lock()
+				w.enforceLimits()
+				w.updateMetrics()
+				w.mtx.Unlock()
+			}
+			continue
+		}
+		backoff := walRetryMinBackoff
+		for {
+			err := w.sender()(ctx, rec.events)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				// the record is sent again after a restart.
+				return
+			}
+			if !IsRecoverable(err) {
+				level.Error(w.log).Log("type", "wal", "msg", "drop rejected events", "events", len(rec.events), "err", err)
+				metrics.WALDroppedEvents.Add(float64(len(rec.events)))
+				break
+			}
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > walRetryMaxBackoff {
+				backoff = walRetryMaxBackoff
+			}
+		}
+		w.commit(rec)
+	}
+}
+
+// Drain waits until all records are sent or ctx is done, records left are replayed after a restart.
+func (w *WAL) Drain(ctx context.Context) error {
+	for {
+		w.mtx.Lock()
+		pending := w.pending()
+		w.mtx.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Close stops the replay, aborting a send in progress, and closes the segment being written,
+// unsent records are kept on disk.
+func (w *WAL) Close() error {
+	close(w.stop)
+	w.startOnce.Do(func() {
+		close(w.done)
+	})
+	<-w.done
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.writer == nil {
+		return nil
+	}
+	err := w.writer.Close()
+	w.writer = nil
+	return err
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kebe7jun/ropee/test"
+)
+
+type eventRecorder struct {
+	mtx    sync.Mutex
+	events []SplunkMetricEvent
+	got    chan struct{}
+}
+
+func (r *eventRecorder) send(ctx context.Context, events []SplunkMetricEvent) error {
+	r.mtx.Lock()
+	r.events = append(r.events, events...)
+	r.mtx.Unlock()
+	r.got <- struct{}{}
+	return nil
+}
+
+func walEvents(n int) []SplunkMetricEvent {
+	events := make([]SplunkMetricEvent, 0, n)
+	for i := 0; i < n; i++ {
+		events = append(events, SplunkMetricEvent{Time: int64(i), MetricStr: fmt.Sprintf("test{} %d", i)})
+	}
+	return events
+}
+
+func TestWAL_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ropee-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := OpenWAL(dir, 1, 0, 0, test.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range walEvents(3) {
+		if err := w.Append([]SplunkMetricEvent{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+walSegmentSuffix))
+	if len(files) != 3 {
+		t.Fatalf("unexpected segments: %v", files)
+	}
+
+	w, err = OpenWAL(dir, 1, 0, 0, test.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &eventRecorder{got: make(chan struct{}, 3)}
+	w.start(r.send)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(time.Second):
+			t.Fatal("replay timeout")
+		}
+	}
+	w.Close()
+	for i, e := range walEvents(3) {
+		if !reflect.DeepEqual(r.events[i], e) {
+			t.Fatalf("unexpected events: %v", r.events)
+		}
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, "*"+walSegmentSuffix))
+	if len(files) > 1 {
+		t.Fatalf("sent segments not removed: %v", files)
+	}
+}
+
+func TestWAL_Limits(t *testing.T) {
+	cases := []struct {
+		name        string
+		maxSize     int64
+		maxAge      time.Duration
+		wantPending int
+	}{
+		{
+			"no limit",
+			0,
+			0,
+			4,
+		},
+		{
+			"max size",
+			1,
+			0,
+			1,
+		},
+		{
+			"max age",
+			0,
+			time.Nanosecond,
+			1,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ropee-wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			w, err := OpenWAL(dir, 1, c.maxSize, c.maxAge, test.Logger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			for _, e := range walEvents(4) {
+				if err := w.Append([]SplunkMetricEvent{e}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if w.pending() != c.wantPending {
+				t.Fatalf("unexpected pending: %d, want: %d", w.pending(), c.wantPending)
+			}
+		})
+	}
+}
+
+func TestWAL_TornRecord(t *testing.T) {
+	cases := []struct {
+		name string
+		tail []byte
+	}{
+		{"torn header", []byte{0, 0, 1}},
+		// a header whose length would allocate 4GiB.
+		{"corrupted length", []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1}},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ropee-wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			w, err := OpenWAL(dir, 1024, 0, 0, test.Logger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Append(walEvents(2)); err != nil {
+				t.Fatal(err)
+			}
+			w.Close()
+			f, err := os.OpenFile(w.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(c.tail)
+			f.Close()
+			size := w.segments[0].size
+
+			w, err = OpenWAL(dir, 1024, 0, 0, test.Logger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			if w.pending() != 2 {
+				t.Fatalf("unexpected pending: %d, want: 2", w.pending())
+			}
+			if info, err := os.Stat(w.segmentPath(1)); err != nil || info.Size() != size {
+				t.Fatalf("segment not truncated to %d: %v, %v", size, info.Size(), err)
+			}
+		})
+	}
+}
+
+func TestWAL_Drain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ropee-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := OpenWAL(dir, 1, 0, 0, test.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, e := range walEvents(2) {
+		if err := w.Append([]SplunkMetricEvent{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := w.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected drain error without replay: %v", err)
+	}
+
+	r := &eventRecorder{got: make(chan struct{}, 2)}
+	w.start(r.send)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := w.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.events) != 2 {
+		t.Fatalf("unexpected events: %v", r.events)
+	}
+}
+
+func TestWAL_CloseAbortsSend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ropee-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := OpenWAL(dir, 1, 0, 0, test.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(walEvents(1)); err != nil {
+		t.Fatal(err)
+	}
+	sending := make(chan struct{})
+	// send blocks like a HEC request retrying until it is cancelled.
+	w.start(func(ctx context.Context, events []SplunkMetricEvent) error {
+		close(sending)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	<-sending
+
+	closed := make(chan error)
+	go func() {
+		closed <- w.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close blocked by the send in progress")
+	}
+	if w.pending() != 1 {
+		t.Fatalf("unexpected pending: %d, want: 1", w.pending())
+	}
+}
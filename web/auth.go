@@ -0,0 +1,60 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Auth protects handlers with a bearer token or basic auth credentials, as configured in the
+// authorization settings of prometheus remote_write. The zero value lets every request pass.
+type Auth struct {
+	BearerToken string `yaml:"bearer_token"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+}
+
+// Enabled reports whether credentials are configured.
+func (a Auth) Enabled() bool {
+	return a.BearerToken != "" || a.Username != ""
+}
+
+func (a Auth) authorized(r *http.Request) bool {
+	if a.BearerToken != "" {
+		h := r.Header.Get("Authorization")
+		if strings.HasPrefix(h, "Bearer ") && secureEqual(strings.TrimPrefix(h, "Bearer "), a.BearerToken) {
+			return true
+		}
+	}
+	if a.Username != "" {
+		user, pass, ok := r.BasicAuth()
+		// both are compared so that the time does not reveal which one is wrong.
+		userOk := secureEqual(user, a.Username)
+		passOk := secureEqual(pass, a.Password)
+		if ok && userOk && passOk {
+			return true
+		}
+	}
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Wrap returns a handler answering 401 to requests without the configured credentials.
+func (a Auth) Wrap(h http.Handler) http.Handler {
+	if !a.Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			if a.Username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="ropee"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
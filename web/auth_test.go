@@ -0,0 +1,44 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuth_Wrap(t *testing.T) {
+	cases := []struct {
+		name        string
+		auth        Auth
+		header      string
+		user, pass  string
+		wannaStatus int
+	}{
+		{"disabled", Auth{}, "", "", "", http.StatusOK},
+		{"bearer token", Auth{BearerToken: "secret"}, "Bearer secret", "", "", http.StatusOK},
+		{"wrong bearer token", Auth{BearerToken: "secret"}, "Bearer other", "", "", http.StatusUnauthorized},
+		{"missing bearer token", Auth{BearerToken: "secret"}, "", "", "", http.StatusUnauthorized},
+		{"basic auth", Auth{Username: "prom", Password: "pass"}, "", "prom", "pass", http.StatusOK},
+		{"wrong password", Auth{Username: "prom", Password: "pass"}, "", "prom", "other", http.StatusUnauthorized},
+		{"wrong user", Auth{Username: "prom", Password: "pass"}, "", "other", "pass", http.StatusUnauthorized},
+		{"basic auth with both configured", Auth{BearerToken: "secret", Username: "prom", Password: "pass"}, "", "prom", "pass", http.StatusOK},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("test-%d-%s", i, c.name), func(t *testing.T) {
+			h := c.auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest("POST", "/write", nil)
+			if c.header != "" {
+				req.Header.Set("Authorization", c.header)
+			}
+			if c.user != "" {
+				req.SetBasicAuth(c.user, c.pass)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != c.wannaStatus {
+				t.Fatalf("unexpected status: %d, want: %d", rec.Code, c.wannaStatus)
+			}
+		})
+	}
+}